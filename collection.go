@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// protoCollectionEncoding is the backend encoding returning the payload as a
+// lura collection, mirroring lura's own json-collection
+const protoCollectionEncoding = "proto-collection"
+
+// defaultCollectionKey is the key lura stores collections under, and the one
+// the json-collection output encoding reads
+const defaultCollectionKey = "collection"
+
+// defaultCollectionDecoder decodes a GTFS-realtime FeedMessage into the list
+// of its entities, for the proto-collection encoding
+var defaultCollectionDecoder = protoDecoder{
+	cfg: func() Config {
+		cfg := defaultConfig()
+		cfg.Collection.Field = "entity"
+		return cfg
+	}(),
+	msgType:  defaultMessageType,
+	itemsKey: "entity",
+}
+
+// collectionItemsKey checks the field holding the items is a repeated field of
+// the message and returns the key it is rendered with
+func collectionItemsKey(md protoreflect.MessageDescriptor, field string, useProtoNames bool) (string, error) {
+	fd := md.Fields().ByName(protoreflect.Name(field))
+	if fd == nil {
+		return "", fmt.Errorf("unknown field %s in %s", field, md.FullName())
+	}
+	if !fd.IsList() {
+		return "", fmt.Errorf("%s is not a repeated field", field)
+	}
+	if useProtoNames {
+		return string(fd.Name()), nil
+	}
+	return fd.JSONName(), nil
+}
+
+// collectionKey returns the key the items are wrapped under
+func (d protoDecoder) collectionKey() string {
+	if d.cfg.Collection.Key == "" {
+		return defaultCollectionKey
+	}
+	return d.cfg.Collection.Key
+}
+
+// collect replaces a decoded message by the items of its repeated field,
+// wrapped under the collection key
+func (d protoDecoder) collect(jsonData []byte) ([]byte, error) {
+	v, err := decodeJSON(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	doc, _ := v.(map[string]interface{})
+
+	// Unpopulated repeated fields are omitted unless emit_unpopulated is set
+	items, ok := doc[d.itemsKey]
+	if !ok || items == nil {
+		items = []interface{}{}
+	}
+
+	jsonData, err = json.Marshal(map[string]interface{}{d.collectionKey(): items})
+	if err != nil {
+		return nil, err
+	}
+	return d.cfg.Marshal.reformat(jsonData)
+}
+
+// newCollectionDecoder returns a lura decoder storing the items of the
+// decoded message under the collection key of d
+func newCollectionDecoder(d protoDecoder) func(io.Reader, *map[string]interface{}) error {
+	return func(r io.Reader, v *map[string]interface{}) error {
+		l := newLogger("[ENCODING: " + protoCollectionEncoding + "]")
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			l.Error("Failed to read data:", err.Error())
+			return err
+		}
+
+		message := d.msgType.New().Interface()
+		if err := proto.Unmarshal(data, message); err != nil {
+			l.Error("Failed to unmarshal protobuf:", err.Error())
+			de := newDecodeError(http.StatusBadGateway, errCodeInvalidPayload, "Failed to parse protobuf data", err)
+			de.Offset = findErrorOffset(d.msgType.Descriptor(), data)
+			return de
+		}
+
+		jsonData, err := d.toJSON(message, d.cfg.Marshal)
+		if err == nil {
+			jsonData, err = d.collect(jsonData)
+		}
+		if err != nil {
+			l.Error("Failed to marshal to JSON:", err.Error())
+			return newDecodeError(http.StatusInternalServerError, errCodeMarshal, "Failed to convert protobuf to JSON", err)
+		}
+
+		return json.Unmarshal(jsonData, v)
+	}
+}
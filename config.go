@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Error modes, deciding what the client gets when a payload cannot be decoded
+const (
+	errorModeEnvelope    = "envelope"
+	errorModePassthrough = "passthrough"
+)
+
+// Compression modes for the upstream payload
+const (
+	compressionAuto = "auto"
+	compressionGzip = "gzip"
+	compressionNone = "none"
+)
+
+// Debug modes, replacing or augmenting the decoded payload for diagnostics
+const (
+	debugModeOff        = "off"
+	debugModeEchoStatic = "echo-static"
+	debugModeDumpHex    = "dump-hex"
+	debugModeDumpBoth   = "dump-both"
+)
+
+// Input formats of the upstream payload
+const (
+	inputFormatSingle    = "single"
+	inputFormatDelimited = "delimited"
+)
+
+// Decode modes, deciding whether the payload is decoded with a schema
+const (
+	decodeModeSchema = "schema"
+	decodeModeRaw    = "raw"
+)
+
+// Transforms, replacing the decoded message by another representation
+const (
+	transformNone      = "none"
+	transformGeoJSON   = "geojson"
+	transformStopTimes = "stop_times"
+)
+
+// What the area filters do with the entities without a vehicle position
+const (
+	withoutPositionDrop = "drop"
+	withoutPositionKeep = "keep"
+)
+
+// Output formats of a delimited stream
+const (
+	streamOutputArray  = "array"
+	streamOutputNDJSON = "ndjson"
+)
+
+// Config is the per-backend plugin configuration, read from the extra_config
+// key named after the plugin
+type Config struct {
+	// Schema of the upstream payload, see schemaConfig
+	MessageType   string   `json:"message_type"`
+	DescriptorSet string   `json:"descriptor_set"`
+	ProtoFiles    []string `json:"proto_files"`
+	ImportPaths   []string `json:"import_paths"`
+
+	// One of decodeModeSchema or decodeModeRaw
+	DecodeMode string `json:"decode_mode"`
+
+	// How the decoded message is rendered as JSON
+	Marshal MarshalConfig `json:"marshal"`
+
+	// One of inputFormatSingle or inputFormatDelimited
+	InputFormat string `json:"input_format"`
+	// One of streamOutputArray or streamOutputNDJSON, for delimited input
+	StreamOutput string `json:"stream_output"`
+
+	// Maximum size in bytes of the (decompressed) upstream payload, 0 for no
+	// limit. For delimited input it applies to every message of the stream.
+	MaxBodySize int64 `json:"max_body_size"`
+	// One of errorModeEnvelope or errorModePassthrough
+	ErrorMode string `json:"error_mode"`
+	// One of compressionAuto, compressionGzip or compressionNone
+	Compression string `json:"compression"`
+	// One of the debugMode* constants, debugModeOff in production
+	DebugMode string `json:"debug_mode"`
+	// Render the fields missing from the schema under unknownFieldsKey
+	UnknownFields bool `json:"unknown_fields"`
+	// One of the transform* constants, transformNone for the decoded message
+	Transform string `json:"transform"`
+	// Output of the stop_times transform
+	Table TableConfig `json:"table"`
+
+	Filters FilterConfig `json:"filters"`
+
+	Collection CollectionConfig `json:"collection"`
+
+	Request RequestConfig `json:"request"`
+
+	Merge MergeConfig `json:"merge"`
+
+	Incremental IncrementalConfig `json:"incremental"`
+
+	Validation ValidationConfig `json:"validation"`
+
+	Staleness StalenessConfig `json:"staleness"`
+
+	Timestamps TimestampConfig `json:"timestamps"`
+}
+
+// MarshalConfig maps to protojson.MarshalOptions
+type MarshalConfig struct {
+	UseProtoNames     bool   `json:"use_proto_names"`
+	EmitUnpopulated   bool   `json:"emit_unpopulated"`
+	UseEnumNumbers    bool   `json:"use_enum_numbers"`
+	EmitDefaultValues bool   `json:"emit_default_values"`
+	Multiline         bool   `json:"multiline"`
+	Indent            string `json:"indent"`
+	AllowPartial      bool   `json:"allow_partial"`
+}
+
+// FilterConfig restricts the decoded message to a subset of its fields
+type FilterConfig struct {
+	// Dotted field paths to keep, e.g. "entity.trip_update". Empty keeps all.
+	Include []string `json:"include"`
+	// Select the entities of a GTFS-realtime feed with the query strings of
+	// the request, see entityFilter
+	Query bool `json:"query"`
+	// One of withoutPositionDrop or withoutPositionKeep, for the entities
+	// without a vehicle position when filtering by area
+	WithoutPosition string `json:"without_position"`
+}
+
+// CollectionConfig returns the payload as a lura collection: a list of items
+// wrapped under a single key, as the json-collection encoding does
+type CollectionConfig struct {
+	// Repeated field of the message holding the items, e.g. "entity". Not
+	// used with delimited input, where every message is an item.
+	Field string `json:"field"`
+	// Key the items are wrapped under, defaultCollectionKey when empty
+	Key string `json:"key"`
+}
+
+// TableConfig sets the output of the stop_times transform, one row per stop
+// time update
+type TableConfig struct {
+	// One of tableFormatCSV or tableFormatNDJSON
+	Format string `json:"format"`
+	// Columns to output, in order, defaultStopTimeColumns when empty
+	Columns []string `json:"columns"`
+}
+
+// RequestConfig encodes the JSON request bodies sent by clients to protobuf
+// before they are forwarded to the backend
+type RequestConfig struct {
+	// Full name of the message the body is encoded to, loaded from the same
+	// schema source as message_type. Empty forwards bodies untouched.
+	MessageType string `json:"message_type"`
+	// Ignore the JSON fields that are not in the message instead of
+	// rejecting the request
+	DiscardUnknown bool `json:"discard_unknown"`
+}
+
+// MergeConfig prepares the feeds of a backend to be merged with the ones of
+// other backends by the gtfs-merge combiner
+type MergeConfig struct {
+	// Prepended to the id of every entity, keeping apart the entities of
+	// feeds using the same ids. Empty leaves the ids as they are.
+	IDPrefix string `json:"id_prefix"`
+}
+
+// IncrementalConfig handles GTFS-realtime backends publishing DIFFERENTIAL
+// feeds
+type IncrementalConfig struct {
+	// Keep the full dataset of the backend in memory, apply the differential
+	// feeds onto it and serve the result, see feedDataset
+	Apply bool `json:"apply"`
+	// Answer the requests with a since query string with the changes since
+	// the feed of that timestamp, see feedHistory
+	Since bool `json:"since"`
+	// Number of feeds kept for the since query string
+	History int `json:"history"`
+}
+
+// ValidationConfig checks the GTFS-realtime feeds received against the
+// validationRules
+type ValidationConfig struct {
+	// One of the validationMode* constants
+	Mode string `json:"mode"`
+	// Codes of the rules not to check
+	Ignore []string `json:"ignore"`
+	// Maximum number of findings listed, the counts covering them all
+	MaxFindings int `json:"max_findings"`
+}
+
+// StalenessConfig detects the GTFS-realtime feeds an upstream stopped
+// updating
+type StalenessConfig struct {
+	// Age past which a feed or an entity is stale, as a duration such as
+	// "90s". Empty disables the checks.
+	MaxAge string `json:"max_age"`
+	// One of the staleness* actions
+	Action string `json:"action"`
+}
+
+// TimestampConfig adds RFC 3339 renderings of the POSIX timestamps of the
+// decoded message, see timestampFields
+type TimestampConfig struct {
+	// Dotted field paths of the timestamps, e.g. "header.timestamp"
+	Fields []string `json:"fields"`
+	// IANA name of the timezone the timestamps are rendered in
+	Timezone string `json:"timezone"`
+	// Replace the raw values rather than adding a companion key
+	Replace bool `json:"replace"`
+}
+
+// enabled reports whether the collection block has been configured
+func (c CollectionConfig) enabled() bool {
+	return c.Field != "" || c.Key != ""
+}
+
+// defaultConfig returns the settings used when a key is not present
+func defaultConfig() Config {
+	return Config{
+		Marshal: MarshalConfig{
+			UseProtoNames:   true,
+			EmitUnpopulated: true,
+		},
+		DecodeMode:   decodeModeSchema,
+		InputFormat:  inputFormatSingle,
+		StreamOutput: streamOutputArray,
+		ErrorMode:    errorModeEnvelope,
+		Compression:  compressionAuto,
+		DebugMode:    debugModeOff,
+		Transform:    transformNone,
+		Table:        TableConfig{Format: tableFormatCSV},
+		Filters:      FilterConfig{WithoutPosition: withoutPositionDrop},
+		Incremental:  IncrementalConfig{History: defaultHistorySize},
+		Validation:   ValidationConfig{Mode: validationModeOff, MaxFindings: defaultMaxFindings},
+		Staleness:    StalenessConfig{Action: stalenessAnnotate},
+		Timestamps:   TimestampConfig{Timezone: "UTC"},
+	}
+}
+
+// parseConfig builds a Config from the raw extra_config map. Every unknown key
+// and every invalid value is reported, not only the first one found.
+func parseConfig(extra map[string]interface{}) (Config, error) {
+	cfg := defaultConfig()
+
+	var problems []string
+	decodeStruct(reflect.ValueOf(&cfg).Elem(), extra, "", &problems)
+	problems = append(problems, cfg.validate()...)
+
+	if len(problems) > 0 {
+		return cfg, configError(problems)
+	}
+	return cfg, nil
+}
+
+// validate checks the values that are well typed but not acceptable
+func (c Config) validate() []string {
+	var problems []string
+
+	if c.DescriptorSet != "" && len(c.ProtoFiles) > 0 {
+		problems = append(problems, "descriptor_set and proto_files are mutually exclusive")
+	}
+	if c.MessageType == "" && (c.DescriptorSet != "" || len(c.ProtoFiles) > 0) {
+		problems = append(problems, "message_type is required when a schema source is set")
+	}
+	if strings.Trim(c.Marshal.Indent, " \t") != "" {
+		problems = append(problems, "marshal.indent: only spaces and tabs are allowed")
+	}
+	if c.Request.DiscardUnknown && c.Request.MessageType == "" {
+		problems = append(problems, "request.discard_unknown: request.message_type is not set")
+	}
+	if c.MaxBodySize < 0 {
+		problems = append(problems, "max_body_size: must not be negative")
+	}
+
+	switch c.DecodeMode {
+	case decodeModeSchema:
+	case decodeModeRaw:
+		// There is no schema to select fields or items from
+		if c.MessageType != "" || c.DescriptorSet != "" || len(c.ProtoFiles) > 0 {
+			problems = append(problems, "decode_mode: no schema can be set with the raw mode")
+		}
+		if len(c.Filters.Include) > 0 {
+			problems = append(problems, "filters.include: not supported with the raw decode_mode")
+		}
+		if c.Collection.enabled() {
+			problems = append(problems, "collection: not supported with the raw decode_mode")
+		}
+		if c.UnknownFields {
+			problems = append(problems, "unknown_fields: not used with the raw decode_mode, where every field is unknown")
+		}
+		if c.InputFormat == inputFormatDelimited {
+			problems = append(problems, "decode_mode: raw is not supported with the delimited input_format")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("decode_mode: unknown mode %q", c.DecodeMode))
+	}
+
+	switch c.InputFormat {
+	case inputFormatSingle:
+	case inputFormatDelimited:
+		// The stream is consumed as it is decoded, so there is nothing left
+		// to dump or forward once a message fails
+		if c.DebugMode != debugModeOff {
+			problems = append(problems, "debug_mode: not supported with the delimited input_format")
+		}
+		if c.ErrorMode == errorModePassthrough {
+			problems = append(problems, "error_mode: passthrough is not supported with the delimited input_format")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("input_format: unknown format %q", c.InputFormat))
+	}
+
+	switch c.StreamOutput {
+	case streamOutputArray, streamOutputNDJSON:
+	default:
+		problems = append(problems, fmt.Sprintf("stream_output: unknown format %q", c.StreamOutput))
+	}
+
+	if c.Collection.enabled() {
+		if c.InputFormat == inputFormatDelimited && c.Collection.Field != "" {
+			problems = append(problems, "collection.field: not used with the delimited input_format")
+		}
+		if c.InputFormat == inputFormatSingle && c.Collection.Field == "" {
+			problems = append(problems, "collection.field: required unless the input_format is delimited")
+		}
+		if c.InputFormat == inputFormatDelimited && c.StreamOutput == streamOutputNDJSON {
+			problems = append(problems, "collection: not supported with the ndjson stream_output")
+		}
+	}
+
+	if c.DecodeMode == decodeModeRaw || c.InputFormat == inputFormatDelimited {
+		for _, key := range c.requiresFeedMessage() {
+			problems = append(problems, key+": only available for single messages decoded with a schema")
+		}
+	}
+
+	if c.Incremental.Since && c.Transform != transformNone {
+		// Deleted entities have no representation in the transforms
+		problems = append(problems, "incremental.since: cannot be combined with a transform")
+	}
+	if c.Incremental.History < 1 {
+		problems = append(problems, "incremental.history: must be at least 1")
+	}
+
+	switch c.Validation.Mode {
+	case validationModeOff:
+	case validationModeAnnotate, validationModeReport:
+		if c.Transform != transformNone {
+			problems = append(problems, "validation.mode: cannot be combined with a transform")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("validation.mode: unknown mode %q", c.Validation.Mode))
+	}
+	if c.Validation.MaxFindings < 0 {
+		problems = append(problems, "validation.max_findings: must not be negative")
+	}
+	problems = append(problems, checkValidationRules(c.Validation.Ignore)...)
+
+	if c.Staleness.MaxAge != "" {
+		if d, err := time.ParseDuration(c.Staleness.MaxAge); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("staleness.max_age: %q is not a positive duration", c.Staleness.MaxAge))
+		}
+	}
+	switch c.Staleness.Action {
+	case stalenessDrop, stalenessFail:
+	case stalenessAnnotate:
+		if c.Staleness.MaxAge != "" && c.Transform == transformStopTimes {
+			problems = append(problems, "staleness.action: annotate is not supported with the stop_times transform")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("staleness.action: unknown action %q", c.Staleness.Action))
+	}
+
+	if len(c.Timestamps.Fields) > 0 {
+		// The timestamps are found with the schema, in the decoded message
+		if c.DecodeMode == decodeModeRaw {
+			problems = append(problems, "timestamps.fields: not supported with the raw decode_mode")
+		}
+		if c.Transform != transformNone {
+			problems = append(problems, "timestamps.fields: cannot be combined with a transform")
+		}
+	}
+	if _, err := time.LoadLocation(c.Timestamps.Timezone); err != nil {
+		problems = append(problems, fmt.Sprintf("timestamps.timezone: unknown timezone %q", c.Timestamps.Timezone))
+	}
+
+	switch c.Filters.WithoutPosition {
+	case withoutPositionDrop, withoutPositionKeep:
+	default:
+		problems = append(problems, fmt.Sprintf("filters.without_position: unknown action %q", c.Filters.WithoutPosition))
+	}
+
+	switch c.Transform {
+	case transformNone:
+	case transformGeoJSON, transformStopTimes:
+		if c.Collection.enabled() || len(c.Filters.Include) > 0 || c.UnknownFields {
+			problems = append(problems, "transform: cannot be combined with collection, filters.include or unknown_fields")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("transform: unknown transform %q", c.Transform))
+	}
+
+	switch c.Table.Format {
+	case tableFormatCSV, tableFormatNDJSON:
+	default:
+		problems = append(problems, fmt.Sprintf("table.format: unknown format %q", c.Table.Format))
+	}
+	problems = append(problems, checkStopTimeColumns(c.Table.Columns)...)
+	if c.Transform == transformStopTimes && c.DebugMode != debugModeOff {
+		// The debug dumps are JSON documents embedding the decoded JSON
+		problems = append(problems, "debug_mode: not supported with the stop_times transform")
+	}
+
+	switch c.ErrorMode {
+	case errorModeEnvelope, errorModePassthrough:
+	default:
+		problems = append(problems, fmt.Sprintf("error_mode: unknown mode %q", c.ErrorMode))
+	}
+
+	switch c.Compression {
+	case compressionAuto, compressionGzip, compressionNone:
+	default:
+		problems = append(problems, fmt.Sprintf("compression: unknown mode %q", c.Compression))
+	}
+
+	switch c.DebugMode {
+	case debugModeOff, debugModeEchoStatic, debugModeDumpHex, debugModeDumpBoth:
+	default:
+		problems = append(problems, fmt.Sprintf("debug_mode: unknown mode %q", c.DebugMode))
+	}
+
+	return problems
+}
+
+// schema returns the settings needed to load the message type
+func (c Config) schema() schemaConfig {
+	return schemaConfig{
+		MessageType:   c.MessageType,
+		DescriptorSet: c.DescriptorSet,
+		ProtoFiles:    c.ProtoFiles,
+		ImportPaths:   c.ImportPaths,
+	}
+}
+
+// requestSchema returns the settings needed to load the request message type
+func (c Config) requestSchema() schemaConfig {
+	sc := c.schema()
+	sc.MessageType = c.Request.MessageType
+	return sc
+}
+
+// options returns the protojson options matching the config
+func (m MarshalConfig) options() protojson.MarshalOptions {
+	return protojson.MarshalOptions{
+		UseProtoNames:     m.UseProtoNames,
+		EmitUnpopulated:   m.EmitUnpopulated,
+		UseEnumNumbers:    m.UseEnumNumbers,
+		EmitDefaultValues: m.EmitDefaultValues,
+		Multiline:         m.Multiline,
+		Indent:            m.Indent,
+		AllowPartial:      m.AllowPartial,
+	}
+}
+
+// reformat restores the configured layout of a JSON document that has been
+// re-encoded after decoding, e.g. by a field mask
+func (m MarshalConfig) reformat(data []byte) ([]byte, error) {
+	if !m.Multiline && m.Indent == "" {
+		return data, nil
+	}
+	indent := m.Indent
+	if indent == "" {
+		indent = "  "
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", indent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// requiresFeedMessage returns the keys of the settings in use that work on the
+// decoded GTFS-realtime FeedMessage, so need a single message decoded with a
+// schema holding one
+func (c Config) requiresFeedMessage() []string {
+	var keys []string
+	if c.Transform == transformGeoJSON || c.Transform == transformStopTimes {
+		// The output is built from the feed, not from its JSON rendering
+		keys = append(keys, "transform")
+	}
+	if c.Filters.Query {
+		keys = append(keys, "filters.query")
+	}
+	if c.Merge.IDPrefix != "" {
+		keys = append(keys, "merge.id_prefix")
+	}
+	if c.Incremental.Apply {
+		keys = append(keys, "incremental.apply")
+	}
+	if c.Incremental.Since {
+		keys = append(keys, "incremental.since")
+	}
+	if c.Validation.Mode == validationModeAnnotate || c.Validation.Mode == validationModeReport {
+		keys = append(keys, "validation.mode")
+	}
+	if c.Staleness.MaxAge != "" {
+		keys = append(keys, "staleness.max_age")
+	}
+	return keys
+}
+
+// configError lists every problem found in the plugin configuration
+type configError []string
+
+func (e configError) Error() string {
+	return fmt.Sprintf("invalid %s config:\n - %s", ClientRegisterer, strings.Join(e, "\n - "))
+}
+
+// decodeStruct copies the values of raw into the fields of v, matched by their
+// json tag. Nested objects are decoded recursively, prefixing the problems
+// found with the path of the key.
+func decodeStruct(v reflect.Value, raw map[string]interface{}, prefix string, problems *[]string) {
+	fields := map[string]reflect.Value{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag != "" && tag != "-" {
+			fields[tag] = v.Field(i)
+		}
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := raw[key]
+		field, ok := fields[key]
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s%s: unknown key", prefix, key))
+			continue
+		}
+
+		if field.Kind() == reflect.Struct {
+			nested, ok := value.(map[string]interface{})
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("%s%s: expected an object", prefix, key))
+				continue
+			}
+			decodeStruct(field, nested, prefix+key+".", problems)
+			continue
+		}
+
+		// Round trip through JSON so type mismatches are reported
+		// consistently, whatever the representation of the raw value
+		b, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(b, field.Addr().Interface())
+		}
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s%s: expected %s", prefix, key, describeKind(field.Type())))
+		}
+	}
+}
+
+// describeKind names the JSON type expected for a Go type in error messages
+func describeKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Map:
+		return "an object"
+	default:
+		return t.String()
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseConfigDefaults(t *testing.T) {
+	cfg, err := parseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%+v", cfg) != fmt.Sprintf("%+v", defaultConfig()) {
+		t.Errorf("got %+v, want the defaults %+v", cfg, defaultConfig())
+	}
+}
+
+func TestParseConfigValues(t *testing.T) {
+	cfg, err := parseConfig(map[string]interface{}{
+		"message_type":  "acme.v1.Order",
+		"proto_files":   []interface{}{"order.proto"},
+		"max_body_size": float64(1 << 20),
+		"marshal":       map[string]interface{}{"use_proto_names": false, "indent": "\t"},
+		"filters":       map[string]interface{}{"include": []interface{}{"id"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MessageType != "acme.v1.Order" || len(cfg.ProtoFiles) != 1 || cfg.MaxBodySize != 1<<20 {
+		t.Errorf("top level keys not decoded: %+v", cfg)
+	}
+	// Nested keys that are not given keep their default
+	if cfg.Marshal.UseProtoNames || !cfg.Marshal.EmitUnpopulated || cfg.Marshal.Indent != "\t" {
+		t.Errorf("marshal not decoded: %+v", cfg.Marshal)
+	}
+	if len(cfg.Filters.Include) != 1 || cfg.Filters.WithoutPosition != withoutPositionDrop {
+		t.Errorf("filters not decoded: %+v", cfg.Filters)
+	}
+}
+
+func TestParseConfigProblems(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		raw      map[string]interface{}
+		problems []string
+	}{
+		{
+			name:     "unknown key",
+			raw:      map[string]interface{}{"mesage_type": "acme.v1.Order"},
+			problems: []string{"mesage_type: unknown key"},
+		},
+		{
+			name: "unknown nested keys",
+			raw: map[string]interface{}{
+				"marshal":   map[string]interface{}{"use_proto_name": true, "multiline": true},
+				"staleness": map[string]interface{}{"max_age": "90s", "maxage": "90s"},
+			},
+			problems: []string{"marshal.use_proto_name: unknown key", "staleness.maxage: unknown key"},
+		},
+		{
+			name: "type mismatches",
+			raw: map[string]interface{}{
+				"message_type":   float64(1),
+				"max_body_size":  "1MB",
+				"unknown_fields": "yes",
+				"proto_files":    "order.proto",
+				"incremental":    map[string]interface{}{"history": 2.5},
+			},
+			problems: []string{
+				"incremental.history: expected an integer",
+				"max_body_size: expected an integer",
+				"message_type: expected a string",
+				"proto_files: expected a list",
+				"unknown_fields: expected a boolean",
+			},
+		},
+		{
+			name:     "object expected",
+			raw:      map[string]interface{}{"marshal": true},
+			problems: []string{"marshal: expected an object"},
+		},
+		{
+			name: "descriptor_set and proto_files",
+			raw: map[string]interface{}{
+				"message_type":   "acme.v1.Order",
+				"descriptor_set": "order.binpb",
+				"proto_files":    []interface{}{"order.proto"},
+			},
+			problems: []string{"descriptor_set and proto_files are mutually exclusive"},
+		},
+		{
+			name:     "schema source without message_type",
+			raw:      map[string]interface{}{"descriptor_set": "order.binpb"},
+			problems: []string{"message_type is required when a schema source is set"},
+		},
+		{
+			name: "raw decode_mode with a schema and schema features",
+			raw: map[string]interface{}{
+				"decode_mode":    "raw",
+				"message_type":   "acme.v1.Order",
+				"unknown_fields": true,
+				"filters":        map[string]interface{}{"include": []interface{}{"id"}},
+			},
+			problems: []string{
+				"decode_mode: no schema can be set with the raw mode",
+				"filters.include: not supported with the raw decode_mode",
+				"unknown_fields: not used with the raw decode_mode, where every field is unknown",
+			},
+		},
+		{
+			name: "delimited input with debug and passthrough",
+			raw: map[string]interface{}{
+				"input_format": "delimited",
+				"debug_mode":   "dump-hex",
+				"error_mode":   "passthrough",
+			},
+			problems: []string{
+				"debug_mode: not supported with the delimited input_format",
+				"error_mode: passthrough is not supported with the delimited input_format",
+			},
+		},
+		{
+			name: "features needing a single FeedMessage",
+			raw: map[string]interface{}{
+				"input_format": "delimited",
+				"filters":      map[string]interface{}{"query": true},
+				"merge":        map[string]interface{}{"id_prefix": "a:"},
+				"staleness":    map[string]interface{}{"max_age": "90s"},
+			},
+			problems: []string{
+				"filters.query: only available for single messages decoded with a schema",
+				"merge.id_prefix: only available for single messages decoded with a schema",
+				"staleness.max_age: only available for single messages decoded with a schema",
+			},
+		},
+		{
+			name: "since with a transform",
+			raw: map[string]interface{}{
+				"transform":   "geojson",
+				"incremental": map[string]interface{}{"since": true},
+			},
+			problems: []string{"incremental.since: cannot be combined with a transform"},
+		},
+		{
+			name: "transform with collection and unknown fields",
+			raw: map[string]interface{}{
+				"transform":      "stop_times",
+				"unknown_fields": true,
+			},
+			problems: []string{"transform: cannot be combined with collection, filters.include or unknown_fields"},
+		},
+		{
+			name: "unknown enumerated values",
+			raw: map[string]interface{}{
+				"decode_mode": "guess",
+				"transform":   "svg",
+				"validation":  map[string]interface{}{"mode": "strict"},
+				"staleness":   map[string]interface{}{"action": "retry"},
+			},
+			problems: []string{
+				`decode_mode: unknown mode "guess"`,
+				`validation.mode: unknown mode "strict"`,
+				`staleness.action: unknown action "retry"`,
+				`transform: unknown transform "svg"`,
+			},
+		},
+		{
+			name: "out of range values",
+			raw: map[string]interface{}{
+				"max_body_size": float64(-1),
+				"marshal":       map[string]interface{}{"indent": "--"},
+				"incremental":   map[string]interface{}{"history": float64(0)},
+				"staleness":     map[string]interface{}{"max_age": "-5s"},
+				"timestamps":    map[string]interface{}{"timezone": "Mars/Olympus"},
+			},
+			problems: []string{
+				"marshal.indent: only spaces and tabs are allowed",
+				"max_body_size: must not be negative",
+				"incremental.history: must be at least 1",
+				`staleness.max_age: "-5s" is not a positive duration`,
+				`timestamps.timezone: unknown timezone "Mars/Olympus"`,
+			},
+		},
+		{
+			name: "type and value problems together",
+			raw: map[string]interface{}{
+				"bogus":       true,
+				"decode_mode": "guess",
+			},
+			problems: []string{"bogus: unknown key", `decode_mode: unknown mode "guess"`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseConfig(tc.raw)
+			ce, ok := err.(configError)
+			if !ok {
+				t.Fatalf("got error %v, want a configError", err)
+			}
+			if fmt.Sprintf("%q", []string(ce)) != fmt.Sprintf("%q", tc.problems) {
+				t.Errorf("got problems\n%q\nwant\n%q", []string(ce), tc.problems)
+			}
+		})
+	}
+}
+
+func TestConfigErrorText(t *testing.T) {
+	_, err := parseConfig(map[string]interface{}{
+		"bogus":   true,
+		"marshal": map[string]interface{}{"multiline": "yes"},
+	})
+	want := "invalid krakend-pb-to-json config:\n" +
+		" - bogus: unknown key\n" +
+		" - marshal.multiline: expected a boolean"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// staticDebugResponse is returned in echo-static mode, to check the plugin is
+// wired into the endpoint without looking at the payload at all
+const staticDebugResponse = `{"test": "This is a test response from the proto decoder plugin"}`
+
+// debugDump describes a raw payload and, in dump-both mode, the JSON decoded
+// from it or the reason it could not be decoded
+type debugDump struct {
+	DebugMode string          `json:"debug_mode"`
+	Size      int             `json:"size"`
+	Hex       string          `json:"hex"`
+	Decoded   json.RawMessage `json:"decoded,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// newDebugDump builds the diagnostic response for the dump-* debug modes
+func newDebugDump(mode string, data, decoded []byte, decodeErr error) ([]byte, error) {
+	dump := debugDump{
+		DebugMode: mode,
+		Size:      len(data),
+		Hex:       fmt.Sprintf("% x", data),
+		Decoded:   decoded,
+	}
+	if decodeErr != nil {
+		dump.Error = decodeErr.Error()
+	}
+	return json.Marshal(dump)
+}
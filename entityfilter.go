@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// Query strings selecting the entities of a GTFS-realtime feed
+const (
+	queryRouteID     = "route_id"
+	queryTripID      = "trip_id"
+	queryStopID      = "stop_id"
+	queryDirectionID = "direction_id"
+	queryAgencyID    = "agency_id"
+	queryEntityType  = "entity_type"
+	queryBBox        = "bbox"
+	queryNear        = "near"
+	queryRadius      = "radius"
+)
+
+// earthRadius is the mean radius of the Earth in meters, used by the near
+// filter
+const earthRadius = 6371008.8
+
+// entityTypes are the values accepted by the entity_type query string, named
+// after the FeedEntity fields
+var entityTypes = map[string]bool{
+	"trip_update":        true,
+	"vehicle":            true,
+	"alert":              true,
+	"shape":              true,
+	"stop":               true,
+	"trip_modifications": true,
+}
+
+// entityFilter keeps the entities of a feed matching every criterion set.
+// A criterion matches when any of its values does, and a nil set is not
+// checked, so the zero value keeps everything.
+type entityFilter struct {
+	routeIDs     map[string]bool
+	tripIDs      map[string]bool
+	stopIDs      map[string]bool
+	agencyIDs    map[string]bool
+	directionIDs map[uint32]bool
+	types        map[string]bool
+
+	// Area vehicle positions must be in
+	bbox *boundingBox
+	near *circle
+	// Whether the entities without a vehicle position pass the area checks
+	keepUnpositioned bool
+}
+
+// boundingBox is a longitude and latitude range, in degrees. A box whose
+// minimum longitude is greater than its maximum crosses the antimeridian.
+type boundingBox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// circle is a point, in degrees, and a radius around it, in meters
+type circle struct {
+	lat, lon, radius float64
+}
+
+// parseEntityFilter reads the filter from the query strings of a request.
+// Every query string takes a comma separated list of values, and may be
+// repeated, but for the area ones which take a single set of coordinates.
+func parseEntityFilter(q url.Values, fc FilterConfig) (entityFilter, error) {
+	f := entityFilter{
+		routeIDs:         queryValues(q, queryRouteID),
+		tripIDs:          queryValues(q, queryTripID),
+		stopIDs:          queryValues(q, queryStopID),
+		agencyIDs:        queryValues(q, queryAgencyID),
+		types:            queryValues(q, queryEntityType),
+		keepUnpositioned: fc.WithoutPosition == withoutPositionKeep,
+	}
+
+	for t := range f.types {
+		if !entityTypes[t] {
+			return entityFilter{}, invalidQuery(queryEntityType, fmt.Errorf("unknown entity type %q", t))
+		}
+	}
+
+	if directions := queryValues(q, queryDirectionID); directions != nil {
+		f.directionIDs = map[uint32]bool{}
+		for d := range directions {
+			n, err := strconv.ParseUint(d, 10, 32)
+			if err != nil {
+				return entityFilter{}, invalidQuery(queryDirectionID, err)
+			}
+			f.directionIDs[uint32(n)] = true
+		}
+	}
+
+	if v := q.Get(queryBBox); v != "" {
+		c, err := parseCoordinates(v, 4)
+		if err != nil {
+			return entityFilter{}, invalidQuery(queryBBox, err)
+		}
+		f.bbox = &boundingBox{minLon: c[0], minLat: c[1], maxLon: c[2], maxLat: c[3]}
+		if err := checkLatLon(f.bbox.minLat, f.bbox.minLon); err != nil {
+			return entityFilter{}, invalidQuery(queryBBox, err)
+		}
+		if err := checkLatLon(f.bbox.maxLat, f.bbox.maxLon); err != nil {
+			return entityFilter{}, invalidQuery(queryBBox, err)
+		}
+		if f.bbox.minLat > f.bbox.maxLat {
+			return entityFilter{}, invalidQuery(queryBBox, errors.New("minimum latitude above the maximum"))
+		}
+	}
+
+	near, radius := q.Get(queryNear), q.Get(queryRadius)
+	if near != "" || radius != "" {
+		if near == "" || radius == "" {
+			return entityFilter{}, invalidQuery(queryNear, errors.New("near and radius go together"))
+		}
+		c, err := parseCoordinates(near, 2)
+		if err == nil {
+			err = checkLatLon(c[0], c[1])
+		}
+		if err != nil {
+			return entityFilter{}, invalidQuery(queryNear, err)
+		}
+		r, err := strconv.ParseFloat(radius, 64)
+		if err == nil && !(r > 0) {
+			err = errors.New("must be a positive number of meters")
+		}
+		if err != nil {
+			return entityFilter{}, invalidQuery(queryRadius, err)
+		}
+		f.near = &circle{lat: c[0], lon: c[1], radius: r}
+	}
+	return f, nil
+}
+
+// parseCoordinates reads a comma separated list of n numbers
+func parseCoordinates(v string, n int) ([]float64, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d comma separated numbers, got %q", n, v)
+	}
+	c := make([]float64, n)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = f
+	}
+	return c, nil
+}
+
+// checkLatLon checks a point is on Earth
+func checkLatLon(lat, lon float64) error {
+	if !(lat >= -90 && lat <= 90) || !(lon >= -180 && lon <= 180) {
+		return fmt.Errorf("%g,%g is out of range", lat, lon)
+	}
+	return nil
+}
+
+// queryValues returns the set of values of a query string, nil when absent
+func queryValues(q url.Values, key string) map[string]bool {
+	var set map[string]bool
+	for _, v := range q[key] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			if set == nil {
+				set = map[string]bool{}
+			}
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// invalidQuery reports a query string that cannot be used as a filter
+func invalidQuery(key string, err error) error {
+	return newDecodeError(http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid %s query string", key), err)
+}
+
+// active reports whether the filter removes anything
+func (f entityFilter) active() bool {
+	return f.routeIDs != nil || f.tripIDs != nil || f.stopIDs != nil ||
+		f.agencyIDs != nil || f.directionIDs != nil || f.types != nil ||
+		f.bbox != nil || f.near != nil
+}
+
+// apply removes the entities not matching the filter from a feed
+func (f entityFilter) apply(feed *pbproto.FeedMessage) {
+	if !f.active() {
+		return
+	}
+	kept := feed.Entity[:0]
+	for _, e := range feed.GetEntity() {
+		if f.match(e) {
+			kept = append(kept, e)
+		}
+	}
+	feed.Entity = kept
+}
+
+// match checks an entity against the filter. Trip updates and vehicle
+// positions are matched on their trip and stops, alerts on their informed
+// entities. Criteria an entity has no data for do not match.
+func (f entityFilter) match(e *pbproto.FeedEntity) bool {
+	if f.types != nil && !f.types[entityType(e)] {
+		return false
+	}
+	if !f.matchPosition(e.GetVehicle().GetPosition()) {
+		return false
+	}
+
+	switch {
+	case e.TripUpdate != nil:
+		tu := e.GetTripUpdate()
+		return f.agencyIDs == nil && f.matchTrip(tu.GetTrip()) && f.matchStops(stopTimeStops(tu)...)
+	case e.Vehicle != nil:
+		vp := e.GetVehicle()
+		var stops []string
+		if vp.StopId != nil {
+			stops = append(stops, vp.GetStopId())
+		}
+		return f.agencyIDs == nil && f.matchTrip(vp.GetTrip()) && f.matchStops(stops...)
+	case e.Alert != nil:
+		for _, s := range e.GetAlert().GetInformedEntity() {
+			if f.matchSelector(s) {
+				return true
+			}
+		}
+		return false
+	default:
+		// Other entities carry none of the fields the filter checks
+		return f.routeIDs == nil && f.tripIDs == nil && f.stopIDs == nil &&
+			f.agencyIDs == nil && f.directionIDs == nil
+	}
+}
+
+// matchPosition checks a vehicle position against the area filters. Entities
+// without one, including the ones that are not vehicles, only pass when
+// configured to.
+func (f entityFilter) matchPosition(pos *pbproto.Position) bool {
+	if f.bbox == nil && f.near == nil {
+		return true
+	}
+	if pos == nil {
+		return f.keepUnpositioned
+	}
+	lat, lon := float64(pos.GetLatitude()), float64(pos.GetLongitude())
+	return (f.bbox == nil || f.bbox.contains(lat, lon)) &&
+		(f.near == nil || f.near.contains(lat, lon))
+}
+
+// contains reports whether a point is in the box
+func (b boundingBox) contains(lat, lon float64) bool {
+	if lat < b.minLat || lat > b.maxLat {
+		return false
+	}
+	if b.minLon <= b.maxLon {
+		return lon >= b.minLon && lon <= b.maxLon
+	}
+	return lon >= b.minLon || lon <= b.maxLon
+}
+
+// contains reports whether a point is within the radius, along a great
+// circle as given by the haversine formula
+func (c circle) contains(lat, lon float64) bool {
+	lat1, lat2 := radians(c.lat), radians(lat)
+	dLat, dLon := radians(lat-c.lat), radians(lon-c.lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	d := 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+	return d <= c.radius
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// matchTrip checks the route, trip and direction of a trip descriptor
+func (f entityFilter) matchTrip(t *pbproto.TripDescriptor) bool {
+	if t == nil {
+		t = &pbproto.TripDescriptor{}
+	}
+	return matchString(f.routeIDs, t.RouteId) &&
+		matchString(f.tripIDs, t.TripId) &&
+		matchDirection(f.directionIDs, t.DirectionId)
+}
+
+// matchStops checks whether any of the stops of an entity is selected
+func (f entityFilter) matchStops(stops ...string) bool {
+	if f.stopIDs == nil {
+		return true
+	}
+	for _, s := range stops {
+		if f.stopIDs[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSelector checks an informed entity of an alert. The route and the
+// direction may be given by the selector itself or by its trip.
+func (f entityFilter) matchSelector(s *pbproto.EntitySelector) bool {
+	trip := s.GetTrip()
+	route, direction := s.RouteId, s.DirectionId
+	if route == nil && trip != nil {
+		route = trip.RouteId
+	}
+	if direction == nil && trip != nil {
+		direction = trip.DirectionId
+	}
+	var tripID *string
+	if trip != nil {
+		tripID = trip.TripId
+	}
+
+	return matchString(f.routeIDs, route) &&
+		matchString(f.tripIDs, tripID) &&
+		matchString(f.stopIDs, s.StopId) &&
+		matchString(f.agencyIDs, s.AgencyId) &&
+		matchDirection(f.directionIDs, direction)
+}
+
+// matchString checks an optional field against a set of values
+func matchString(set map[string]bool, v *string) bool {
+	return set == nil || (v != nil && set[*v])
+}
+
+// matchDirection checks an optional direction against a set of values
+func matchDirection(set map[uint32]bool, v *uint32) bool {
+	return set == nil || (v != nil && set[*v])
+}
+
+// stopTimeStops lists the stops of the stop time updates of a trip update
+func stopTimeStops(tu *pbproto.TripUpdate) []string {
+	var stops []string
+	for _, stu := range tu.GetStopTimeUpdate() {
+		if stu.StopId != nil {
+			stops = append(stops, stu.GetStopId())
+		}
+	}
+	return stops
+}
+
+// entityType names the data held by an entity, as the entity_type query
+// string does. Deleted entities may hold none.
+func entityType(e *pbproto.FeedEntity) string {
+	switch {
+	case e.TripUpdate != nil:
+		return "trip_update"
+	case e.Vehicle != nil:
+		return "vehicle"
+	case e.Alert != nil:
+		return "alert"
+	case e.Shape != nil:
+		return "shape"
+	case e.Stop != nil:
+		return "stop"
+	case e.TripModifications != nil:
+		return "trip_modifications"
+	}
+	return ""
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+func TestParseEntityFilterErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		// Message of the error, empty when the query is valid
+		message string
+	}{
+		{query: ""},
+		{query: "route_id=1,2&route_id=3&entity_type=vehicle,alert&direction_id=0"},
+		{query: "bbox=179,-10,-179,10"},
+		{query: "bbox=-180,-90,180,90"},
+		{query: "near=41.4,2.1&radius=500"},
+		{query: "entity_type=bus", message: "Invalid entity_type query string"},
+		{query: "direction_id=-1", message: "Invalid direction_id query string"},
+		{query: "direction_id=north", message: "Invalid direction_id query string"},
+		{query: "bbox=1,2,3", message: "Invalid bbox query string"},
+		{query: "bbox=1,2,3,north", message: "Invalid bbox query string"},
+		{query: "bbox=-181,0,10,10", message: "Invalid bbox query string"},
+		{query: "bbox=0,0,10,91", message: "Invalid bbox query string"},
+		{query: "bbox=0,NaN,10,10", message: "Invalid bbox query string"},
+		{query: "bbox=0,10,10,0", message: "Invalid bbox query string"},
+		{query: "near=41.4,2.1", message: "Invalid near query string"},
+		{query: "radius=500", message: "Invalid near query string"},
+		{query: "near=41.4&radius=500", message: "Invalid near query string"},
+		{query: "near=91,2.1&radius=500", message: "Invalid near query string"},
+		{query: "near=41.4,181&radius=500", message: "Invalid near query string"},
+		{query: "near=41.4,2.1&radius=0", message: "Invalid radius query string"},
+		{query: "near=41.4,2.1&radius=-5", message: "Invalid radius query string"},
+		{query: "near=41.4,2.1&radius=NaN", message: "Invalid radius query string"},
+		{query: "near=41.4,2.1&radius=far", message: "Invalid radius query string"},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = parseEntityFilter(q, FilterConfig{})
+			if tc.message == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			de, ok := err.(*decodeError)
+			if !ok {
+				t.Fatalf("got error %v, want a decodeError", err)
+			}
+			if de.Status != http.StatusBadRequest || de.Message != tc.message {
+				t.Errorf("got %d %q, want %d %q", de.Status, de.Message, http.StatusBadRequest, tc.message)
+			}
+		})
+	}
+}
+
+func TestBoundingBoxContains(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		box      boundingBox
+		lat, lon float64
+		want     bool
+	}{
+		{name: "inside", box: boundingBox{0, 40, 4, 43}, lat: 41.4, lon: 2.1, want: true},
+		{name: "on the corner", box: boundingBox{0, 40, 4, 43}, lat: 43, lon: 0, want: true},
+		{name: "west", box: boundingBox{0, 40, 4, 43}, lat: 41.4, lon: -0.1},
+		{name: "north", box: boundingBox{0, 40, 4, 43}, lat: 43.1, lon: 2.1},
+		{name: "across 180, east side", box: boundingBox{170, -20, -170, 20}, lat: 0, lon: 175, want: true},
+		{name: "across 180, west side", box: boundingBox{170, -20, -170, 20}, lat: 0, lon: -175, want: true},
+		{name: "across 180, on 180", box: boundingBox{170, -20, -170, 20}, lat: 0, lon: 180, want: true},
+		{name: "across 180, on -180", box: boundingBox{170, -20, -170, 20}, lat: 0, lon: -180, want: true},
+		{name: "across 180, on the edge", box: boundingBox{170, -20, -170, 20}, lat: 20, lon: -170, want: true},
+		{name: "across 180, greenwich", box: boundingBox{170, -20, -170, 20}, lat: 0, lon: 0},
+		{name: "across 180, between the edges", box: boundingBox{170, -20, -170, 20}, lat: 0, lon: 169.9},
+		{name: "across 180, south", box: boundingBox{170, -20, -170, 20}, lat: -20.1, lon: 180},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.box.contains(tc.lat, tc.lon); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCircleContains(t *testing.T) {
+	// A degree along the equator or a meridian is 111195.08 meters
+	for _, tc := range []struct {
+		name     string
+		circle   circle
+		lat, lon float64
+		want     bool
+	}{
+		{name: "center", circle: circle{41.4, 2.1, 1}, lat: 41.4, lon: 2.1, want: true},
+		{name: "a degree east, on the radius", circle: circle{0, 0, radians(1) * earthRadius}, lat: 0, lon: 1, want: true},
+		{name: "a degree east, within", circle: circle{0, 0, 111196}, lat: 0, lon: 1, want: true},
+		{name: "a degree east, beyond", circle: circle{0, 0, 111195}, lat: 0, lon: 1},
+		{name: "a degree north, on the radius", circle: circle{0, 0, radians(1) * earthRadius}, lat: 1, lon: 0, want: true},
+		{name: "a degree north, within", circle: circle{0, 0, 111196}, lat: 1, lon: 0, want: true},
+		{name: "a degree north, beyond", circle: circle{0, 0, 111195}, lat: 1, lon: 0},
+		{name: "across 180, within", circle: circle{0, 179.5, 111196}, lat: 0, lon: -179.5, want: true},
+		{name: "across 180, beyond", circle: circle{0, 179.5, 111195}, lat: 0, lon: -179.5},
+		// A degree of longitude shrinks with the cosine of the latitude
+		{name: "a degree east at 60° north", circle: circle{60, 0, 55600}, lat: 60, lon: 1, want: true},
+		{name: "over the pole", circle: circle{89.5, 0, 111196}, lat: 89.5, lon: 180, want: true},
+		{name: "antipode", circle: circle{0, 0, 20015000}, lat: 0, lon: 180},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.circle.contains(tc.lat, tc.lon); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEntityFilterWithoutPosition(t *testing.T) {
+	positioned := func(id string, lat, lon float32) *pbproto.FeedEntity {
+		return &pbproto.FeedEntity{Id: proto.String(id), Vehicle: &pbproto.VehiclePosition{
+			Position: &pbproto.Position{Latitude: proto.Float32(lat), Longitude: proto.Float32(lon)},
+		}}
+	}
+	feed := func() *pbproto.FeedMessage {
+		return &pbproto.FeedMessage{Entity: []*pbproto.FeedEntity{
+			positioned("inside", 41.4, 2.1),
+			positioned("outside", 48.8, 2.3),
+			{Id: proto.String("unpositioned"), Vehicle: &pbproto.VehiclePosition{}},
+			{Id: proto.String("alert"), Alert: &pbproto.Alert{
+				InformedEntity: []*pbproto.EntitySelector{{RouteId: proto.String("1")}},
+			}},
+		}}
+	}
+	for _, tc := range []struct {
+		query  string
+		action string
+		want   []string
+	}{
+		{query: "bbox=0,40,4,43", action: withoutPositionDrop, want: []string{"inside"}},
+		{query: "bbox=0,40,4,43", action: withoutPositionKeep, want: []string{"inside", "unpositioned", "alert"}},
+		{query: "near=41.4,2.1&radius=1000", action: withoutPositionDrop, want: []string{"inside"}},
+		{query: "near=41.4,2.1&radius=1000", action: withoutPositionKeep, want: []string{"inside", "unpositioned", "alert"}},
+		{query: "bbox=0,40,4,43&entity_type=vehicle", action: withoutPositionKeep, want: []string{"inside", "unpositioned"}},
+		// Without an area filter the action does not apply
+		{query: "entity_type=vehicle", action: withoutPositionDrop, want: []string{"inside", "outside", "unpositioned"}},
+	} {
+		t.Run(tc.query+" "+tc.action, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parseEntityFilter(q, FilterConfig{WithoutPosition: tc.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fm := feed()
+			f.apply(fm)
+			var got []string
+			for _, e := range fm.GetEntity() {
+				got = append(got, e.GetId())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEntityFilterMatch(t *testing.T) {
+	trip := &pbproto.TripDescriptor{
+		TripId: proto.String("t1"), RouteId: proto.String("r1"), DirectionId: proto.Uint32(1),
+	}
+	tripUpdate := &pbproto.FeedEntity{Id: proto.String("tu"), TripUpdate: &pbproto.TripUpdate{
+		Trip:           trip,
+		StopTimeUpdate: []*pbproto.TripUpdate_StopTimeUpdate{{StopId: proto.String("s1")}, {StopId: proto.String("s2")}},
+	}}
+	vehicle := &pbproto.FeedEntity{Id: proto.String("vp"), Vehicle: &pbproto.VehiclePosition{
+		Trip: trip, StopId: proto.String("s3"),
+	}}
+	untracked := &pbproto.FeedEntity{Id: proto.String("vp"), Vehicle: &pbproto.VehiclePosition{}}
+	shape := &pbproto.FeedEntity{Id: proto.String("sh"), Shape: &pbproto.Shape{ShapeId: proto.String("sh1")}}
+	for _, tc := range []struct {
+		name   string
+		query  string
+		entity *pbproto.FeedEntity
+		want   bool
+	}{
+		{name: "no filter", query: "", entity: tripUpdate, want: true},
+		{name: "trip update route", query: "route_id=r2,r1", entity: tripUpdate, want: true},
+		{name: "trip update other route", query: "route_id=r2", entity: tripUpdate},
+		{name: "trip update direction", query: "direction_id=1", entity: tripUpdate, want: true},
+		{name: "trip update other direction", query: "direction_id=0", entity: tripUpdate},
+		{name: "trip update stop", query: "stop_id=s2", entity: tripUpdate, want: true},
+		{name: "trip update other stop", query: "stop_id=s3", entity: tripUpdate},
+		{name: "trip update agency", query: "agency_id=a1", entity: tripUpdate},
+		{name: "trip update every criterion", query: "route_id=r1&trip_id=t1&direction_id=1&stop_id=s1", entity: tripUpdate, want: true},
+		{name: "trip update one criterion off", query: "route_id=r1&trip_id=t2", entity: tripUpdate},
+		{name: "vehicle trip", query: "trip_id=t1", entity: vehicle, want: true},
+		{name: "vehicle stop", query: "stop_id=s3", entity: vehicle, want: true},
+		{name: "vehicle agency", query: "agency_id=a1", entity: vehicle},
+		{name: "vehicle without trip", query: "route_id=r1", entity: untracked},
+		{name: "vehicle without stop", query: "stop_id=s3", entity: untracked},
+		{name: "entity type", query: "entity_type=vehicle", entity: vehicle, want: true},
+		{name: "other entity type", query: "entity_type=alert", entity: vehicle},
+		{name: "shape without criteria", query: "entity_type=shape", entity: shape, want: true},
+		{name: "shape with a route", query: "route_id=r1", entity: shape},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parseEntityFilter(q, FilterConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.match(tc.entity); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEntityFilterMatchSelector(t *testing.T) {
+	trip := &pbproto.TripDescriptor{
+		TripId: proto.String("t1"), RouteId: proto.String("r1"), DirectionId: proto.Uint32(1),
+	}
+	for _, tc := range []struct {
+		name     string
+		query    string
+		selector *pbproto.EntitySelector
+		want     bool
+	}{
+		{name: "agency", query: "agency_id=a1", selector: &pbproto.EntitySelector{AgencyId: proto.String("a1")}, want: true},
+		{name: "other agency", query: "agency_id=a1", selector: &pbproto.EntitySelector{AgencyId: proto.String("a2")}},
+		{name: "no agency", query: "agency_id=a1", selector: &pbproto.EntitySelector{RouteId: proto.String("r1")}},
+		{name: "stop", query: "stop_id=s1", selector: &pbproto.EntitySelector{StopId: proto.String("s1")}, want: true},
+		{name: "route of the selector", query: "route_id=r1", selector: &pbproto.EntitySelector{RouteId: proto.String("r1")}, want: true},
+		{name: "route of the trip", query: "route_id=r1", selector: &pbproto.EntitySelector{Trip: trip}, want: true},
+		{name: "selector route over the trip one", query: "route_id=r1", selector: &pbproto.EntitySelector{
+			RouteId: proto.String("r2"), Trip: trip,
+		}},
+		{name: "direction of the selector", query: "direction_id=0", selector: &pbproto.EntitySelector{
+			RouteId: proto.String("r1"), DirectionId: proto.Uint32(0),
+		}, want: true},
+		{name: "direction of the trip", query: "direction_id=1", selector: &pbproto.EntitySelector{Trip: trip}, want: true},
+		{name: "selector direction over the trip one", query: "direction_id=1", selector: &pbproto.EntitySelector{
+			DirectionId: proto.Uint32(0), Trip: trip,
+		}},
+		{name: "no direction", query: "direction_id=0", selector: &pbproto.EntitySelector{RouteId: proto.String("r1")}},
+		{name: "trip", query: "trip_id=t1", selector: &pbproto.EntitySelector{Trip: trip}, want: true},
+		{name: "no trip", query: "trip_id=t1", selector: &pbproto.EntitySelector{RouteId: proto.String("r1")}},
+		{name: "route and agency", query: "route_id=r1&agency_id=a1", selector: &pbproto.EntitySelector{
+			AgencyId: proto.String("a1"), Trip: trip,
+		}, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parseEntityFilter(q, FilterConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.matchSelector(tc.selector); got != tc.want {
+				t.Errorf("matchSelector: got %v, want %v", got, tc.want)
+			}
+			// An alert matches when any of its informed entities does
+			alert := &pbproto.FeedEntity{Id: proto.String("al"), Alert: &pbproto.Alert{
+				InformedEntity: []*pbproto.EntitySelector{{StopId: proto.String("other")}, tc.selector},
+			}}
+			if got := f.match(alert); got != tc.want {
+				t.Errorf("match: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Error codes of the decodeError contract
+const (
+	errCodeUpstream       = "upstream_error"
+	errCodeInvalidPayload = "invalid_payload"
+	errCodeInvalidGzip    = "invalid_gzip"
+	errCodeTooLarge       = "payload_too_large"
+	errCodeMarshal        = "marshal_failed"
+	errCodeInvalidRequest = "invalid_request"
+	errCodeStaleFeed      = "stale_feed"
+	errCodeInvalidConfig  = "invalid_config"
+)
+
+// decodeError is the error contract returned to clients when a payload cannot
+// be turned into JSON. It is always encoded with encoding/json, so it stays
+// valid whatever the underlying error message contains.
+//
+// When the backend sets "return_error_details" in its "backend/http" config,
+// KrakenD forwards this body to the client under that key; otherwise the
+// client only gets the status code.
+type decodeError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+	Backend string `json:"backend,omitempty"`
+	// Offset of the first malformed byte of the payload, when it can be found
+	Offset *int `json:"offset,omitempty"`
+}
+
+func (e *decodeError) Error() string {
+	if e.Details == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Message, e.Details)
+}
+
+// newDecodeError wraps err with the status and code of its class of failure
+func newDecodeError(status int, code, message string, err error) *decodeError {
+	e := &decodeError{Status: status, Code: code, Message: message}
+	if err != nil {
+		e.Details = err.Error()
+	}
+	return e
+}
+
+// writeError renders err as the JSON error contract. Errors that are not a
+// decodeError are reported as upstream failures.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	var de *decodeError
+	if !errors.As(err, &de) {
+		de = newDecodeError(http.StatusBadGateway, errCodeUpstream, "Upstream request failed", err)
+	}
+	if de.Backend == "" {
+		de.Backend = req.URL.Host + req.URL.Path
+	}
+
+	body, _ := json.Marshal(de)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(de.Status)
+	w.Write(body)
+}
+
+// findErrorOffset walks the wire format of data, following the fields that
+// md declares as messages, and returns the offset of the first byte that
+// cannot be parsed. It returns nil when the framing itself is valid.
+func findErrorOffset(md protoreflect.MessageDescriptor, data []byte) *int {
+	pos := 0
+	for pos < len(data) {
+		num, typ, n := protowire.ConsumeTag(data[pos:])
+		if n < 0 {
+			return &pos
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[pos+n:])
+		if m < 0 {
+			offset := pos + n
+			return &offset
+		}
+
+		// Descend into embedded messages, as that is where most of the
+		// payload usually is
+		if typ == protowire.BytesType && md != nil {
+			if fd := md.Fields().ByNumber(num); fd != nil && fd.Message() != nil && !fd.IsMap() {
+				value, prefix := protowire.ConsumeBytes(data[pos+n:])
+				if inner := findErrorOffset(fd.Message(), value); inner != nil {
+					offset := pos + n + prefix - len(value) + *inner
+					return &offset
+				}
+			}
+		}
+		pos += n + m
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// fieldMask keeps a subset of the fields of a decoded message. It is keyed by
+// the names the fields are rendered with in the JSON output, and a nil or
+// empty subtree keeps the whole field.
+type fieldMask map[string]fieldMask
+
+// newFieldMask builds a mask from dotted proto field paths, checking every
+// path against the message descriptor so typos are caught at startup
+func newFieldMask(md protoreflect.MessageDescriptor, paths []string, useProtoNames bool) (fieldMask, error) {
+	mask := fieldMask{}
+	for _, path := range paths {
+		node := mask
+		current := md
+		for _, name := range strings.Split(path, ".") {
+			if current == nil {
+				return nil, fmt.Errorf("%q: %s is not a message", path, name)
+			}
+			fd := current.Fields().ByName(protoreflect.Name(name))
+			if fd == nil {
+				return nil, fmt.Errorf("%q: unknown field %s in %s", path, name, current.FullName())
+			}
+			if fd.IsMap() {
+				return nil, fmt.Errorf("%q: cannot filter inside map field %s", path, name)
+			}
+
+			key := fd.JSONName()
+			if useProtoNames {
+				key = string(fd.Name())
+			}
+			if _, ok := node[key]; !ok {
+				node[key] = fieldMask{}
+			}
+			node = node[key]
+			current = fd.Message()
+		}
+	}
+	return mask, nil
+}
+
+// apply removes the fields not in the mask from a decoded JSON value,
+// descending into repeated fields. Unknown fields are always kept.
+func (m fieldMask) apply(v interface{}) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			m.apply(item)
+		}
+	case map[string]interface{}:
+		for k, child := range t {
+			if k == unknownFieldsKey {
+				continue
+			}
+			sub, ok := m[k]
+			if !ok {
+				delete(t, k)
+				continue
+			}
+			if len(sub) > 0 {
+				sub.apply(child)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// geoJSONFeature is a GeoJSON Feature with a Point geometry
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id,omitempty"`
+	Geometry   geoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type string `json:"type"`
+	// Longitude first, as required by RFC 7946
+	Coordinates [2]json.Number `json:"coordinates"`
+}
+
+// geoJSON renders the vehicle positions of a feed as a GeoJSON
+// FeatureCollection. Entities without a vehicle position, and deleted ones,
+// are left out.
+func geoJSON(feed *pbproto.FeedMessage, mc MarshalConfig) ([]byte, error) {
+	features := []geoJSONFeature{}
+	for _, entity := range feed.GetEntity() {
+		vp := entity.GetVehicle()
+		if entity.GetIsDeleted() || vp.GetPosition() == nil {
+			continue
+		}
+		pos := vp.GetPosition()
+		if !isFinite(pos.GetLatitude()) || !isFinite(pos.GetLongitude()) {
+			continue
+		}
+		features = append(features, geoJSONFeature{
+			Type: "Feature",
+			ID:   entity.GetId(),
+			Geometry: geoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]json.Number{formatFloat32(pos.GetLongitude()), formatFloat32(pos.GetLatitude())},
+			},
+			Properties: vehicleProperties(vp, mc),
+		})
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mc.reformat(jsonData)
+}
+
+// vehicleProperties lists the fields of a vehicle position that are set, named
+// and rendered as the marshal settings ask
+func vehicleProperties(vp *pbproto.VehiclePosition, mc MarshalConfig) map[string]interface{} {
+	props := map[string]interface{}{}
+	set := func(name string, v interface{}) {
+		if !mc.UseProtoNames {
+			name = lowerCamel(name)
+		}
+		props[name] = v
+	}
+	enum := func(e protoreflect.Enum) interface{} {
+		return enumValue(e, mc.UseEnumNumbers)
+	}
+
+	if v := vp.GetVehicle(); v != nil {
+		if v.Id != nil {
+			set("vehicle_id", v.GetId())
+		}
+		if v.Label != nil {
+			set("vehicle_label", v.GetLabel())
+		}
+		if v.LicensePlate != nil {
+			set("license_plate", v.GetLicensePlate())
+		}
+	}
+	if t := vp.GetTrip(); t != nil {
+		if t.TripId != nil {
+			set("trip_id", t.GetTripId())
+		}
+		if t.RouteId != nil {
+			set("route_id", t.GetRouteId())
+		}
+		if t.DirectionId != nil {
+			set("direction_id", t.GetDirectionId())
+		}
+		if t.StartDate != nil {
+			set("start_date", t.GetStartDate())
+		}
+		if t.StartTime != nil {
+			set("start_time", t.GetStartTime())
+		}
+		if t.ScheduleRelationship != nil {
+			set("schedule_relationship", enum(t.GetScheduleRelationship()))
+		}
+	}
+
+	// Values that are not finite have no JSON representation, so are left
+	// out as the positions holding some are
+	pos := vp.GetPosition()
+	if pos.Bearing != nil && isFinite(pos.GetBearing()) {
+		set("bearing", formatFloat32(pos.GetBearing()))
+	}
+	if pos.Speed != nil && isFinite(pos.GetSpeed()) {
+		set("speed", formatFloat32(pos.GetSpeed()))
+	}
+	if pos.Odometer != nil && !math.IsNaN(pos.GetOdometer()) && !math.IsInf(pos.GetOdometer(), 0) {
+		set("odometer", pos.GetOdometer())
+	}
+
+	if vp.CurrentStatus != nil {
+		set("current_status", enum(vp.GetCurrentStatus()))
+	}
+	if vp.CurrentStopSequence != nil {
+		set("current_stop_sequence", vp.GetCurrentStopSequence())
+	}
+	if vp.StopId != nil {
+		set("stop_id", vp.GetStopId())
+	}
+	if vp.Timestamp != nil {
+		set("timestamp", vp.GetTimestamp())
+	}
+	if vp.CongestionLevel != nil {
+		set("congestion_level", enum(vp.GetCongestionLevel()))
+	}
+	if vp.OccupancyStatus != nil {
+		set("occupancy_status", enum(vp.GetOccupancyStatus()))
+	}
+	if vp.OccupancyPercentage != nil {
+		set("occupancy_percentage", vp.GetOccupancyPercentage())
+	}
+	return props
+}
+
+// formatFloat32 renders a float with the shortest representation that reads
+// back as the same float32, e.g. 41.39 rather than 41.38999938964844
+func formatFloat32(f float32) json.Number {
+	return json.Number(strconv.FormatFloat(float64(f), 'f', -1, 32))
+}
+
+// isFinite reports whether f can be rendered as a JSON number
+func isFinite(f float32) bool {
+	return !math.IsNaN(float64(f)) && !math.IsInf(float64(f), 0)
+}
+
+// enumValue renders an enum by name, or by number when asked to or when the
+// number has no name in the schema
+func enumValue(e protoreflect.Enum, useNumbers bool) interface{} {
+	if !useNumbers {
+		if v := e.Descriptor().Values().ByNumber(e.Number()); v != nil {
+			return string(v.Name())
+		}
+	}
+	return int32(e.Number())
+}
+
+// lowerCamel converts a snake_case name to lowerCamelCase, as protojson does
+// for field names
+func lowerCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
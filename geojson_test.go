@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+func TestGeoJSONNonFiniteValues(t *testing.T) {
+	nan, inf := float32(math.NaN()), float32(math.Inf(1))
+	for _, tc := range []struct {
+		name     string
+		position *pbproto.Position
+		// Property keys of the feature, nil when it is left out
+		properties []string
+	}{
+		{
+			name: "finite values",
+			position: &pbproto.Position{
+				Latitude: proto.Float32(41.4), Longitude: proto.Float32(2.1),
+				Bearing: proto.Float32(90), Speed: proto.Float32(12.5), Odometer: proto.Float64(1000),
+			},
+			properties: []string{"bearing", "odometer", "speed"},
+		},
+		{
+			name: "NaN bearing",
+			position: &pbproto.Position{
+				Latitude: proto.Float32(41.4), Longitude: proto.Float32(2.1),
+				Bearing: proto.Float32(nan), Speed: proto.Float32(12.5),
+			},
+			properties: []string{"speed"},
+		},
+		{
+			name: "infinite speed",
+			position: &pbproto.Position{
+				Latitude: proto.Float32(41.4), Longitude: proto.Float32(2.1),
+				Bearing: proto.Float32(90), Speed: proto.Float32(-inf),
+			},
+			properties: []string{"bearing"},
+		},
+		{
+			name: "NaN odometer",
+			position: &pbproto.Position{
+				Latitude: proto.Float32(41.4), Longitude: proto.Float32(2.1),
+				Odometer: proto.Float64(math.NaN()),
+			},
+			properties: []string{},
+		},
+		{
+			name: "infinite odometer",
+			position: &pbproto.Position{
+				Latitude: proto.Float32(41.4), Longitude: proto.Float32(2.1),
+				Odometer: proto.Float64(math.Inf(1)),
+			},
+			properties: []string{},
+		},
+		{
+			name:     "NaN latitude",
+			position: &pbproto.Position{Latitude: proto.Float32(nan), Longitude: proto.Float32(2.1)},
+		},
+		{
+			name:     "infinite longitude",
+			position: &pbproto.Position{Latitude: proto.Float32(41.4), Longitude: proto.Float32(inf)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			feed := &pbproto.FeedMessage{Entity: []*pbproto.FeedEntity{{
+				Id:      proto.String("v"),
+				Vehicle: &pbproto.VehiclePosition{Position: tc.position},
+			}}}
+			data, err := geoJSON(feed, MarshalConfig{UseProtoNames: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fc struct {
+				Features []struct {
+					Properties map[string]interface{} `json:"properties"`
+				} `json:"features"`
+			}
+			if err := json.Unmarshal(data, &fc); err != nil {
+				t.Fatalf("invalid JSON %s: %v", data, err)
+			}
+			if tc.properties == nil {
+				if len(fc.Features) != 0 {
+					t.Errorf("got %d features, want none", len(fc.Features))
+				}
+				return
+			}
+			if len(fc.Features) != 1 {
+				t.Fatalf("got %d features, want 1", len(fc.Features))
+			}
+			keys := []string{}
+			for k := range fc.Features[0].Properties {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if fmt.Sprint(keys) != fmt.Sprint(tc.properties) {
+				t.Errorf("properties: got %v, want %v", keys, tc.properties)
+			}
+		})
+	}
+}
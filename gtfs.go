@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// feedMessageName is the full name of the GTFS-realtime root message
+var feedMessageName = defaultMessageType.Descriptor().FullName()
+
+// checkFeedMessage fails unless a backend decodes GTFS-realtime feeds, for the
+// settings that only make sense for them
+func checkFeedMessage(mt protoreflect.MessageType) error {
+	if name := mt.Descriptor().FullName(); name != feedMessageName {
+		return fmt.Errorf("only available for %s payloads, not %s", feedMessageName, name)
+	}
+	return nil
+}
+
+// asFeedMessage returns a decoded GTFS-realtime message as the compiled-in
+// type. Messages decoded with a schema loaded at runtime are dynamic, and are
+// converted through the wire format.
+func asFeedMessage(message proto.Message) (*pbproto.FeedMessage, error) {
+	if feed, ok := message.(*pbproto.FeedMessage); ok {
+		return feed, nil
+	}
+	data, err := proto.MarshalOptions{AllowPartial: true}.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	feed := &pbproto.FeedMessage{}
+	if err := (proto.UnmarshalOptions{AllowPartial: true}).Unmarshal(data, feed); err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
+
+// fromFeedMessage returns a processed feed as the message type of the backend.
+// Messages decoded with a schema loaded at runtime are converted back through
+// the wire format, where the fields the compiled-in schema lacks were kept as
+// unknown fields.
+func (d protoDecoder) fromFeedMessage(feed *pbproto.FeedMessage) (proto.Message, error) {
+	if feed.ProtoReflect().Type() == d.msgType {
+		return feed, nil
+	}
+	data, err := proto.MarshalOptions{AllowPartial: true}.Marshal(feed)
+	if err != nil {
+		return nil, err
+	}
+	message := d.msgType.New().Interface()
+	if err := (proto.UnmarshalOptions{AllowPartial: true}).Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// usesFeed reports whether the decoded messages are needed as compiled
+// FeedMessages
+func (d protoDecoder) usesFeed() bool {
+	return len(d.cfg.requiresFeedMessage()) > 0
+}
+
+// processesFeed reports whether the decoded feeds are processed, by the
+// dataset of the backend or by prepareFeed
+func (d protoDecoder) processesFeed(ef entityFilter) bool {
+	return d.dataset != nil || d.history != nil || ef.active() || d.cfg.Merge.IDPrefix != "" ||
+		(d.cfg.Staleness.Action == stalenessDrop && d.cfg.Staleness.maxAge() > 0)
+}
+
+// prepareFeed processes a decoded feed, once its full dataset is rebuilt, as
+// configured, in order: it drops the stale entities, keeps the entities asked
+// for by the client, keeps only the changes since the feed the client last
+// saw, and tells the entities apart from the ones of the feeds they are
+// merged with
+func (d protoDecoder) prepareFeed(feed *pbproto.FeedMessage, l requestLogger, ef entityFilter, since uint64) *pbproto.FeedMessage {
+	if d.cfg.Staleness.Action == stalenessDrop {
+		if maxAge := d.cfg.Staleness.maxAge(); maxAge > 0 {
+			dropped := dropStaleEntities(feed, time.Now(), maxAge)
+			l.Debug(fmt.Sprintf("Dropped %d stale entities", dropped))
+		}
+	}
+	if d.history != nil {
+		d.history.record(feed)
+	}
+	if ef.active() {
+		before := len(feed.GetEntity())
+		ef.apply(feed)
+		l.Debug(fmt.Sprintf("Entity filter kept %d of %d entities", len(feed.GetEntity()), before))
+	}
+	if d.history != nil && since != 0 {
+		feed = d.history.changesSince(feed, since, ef, l)
+	}
+	prefixEntityIDs(feed, d.cfg.Merge.IDPrefix)
+	return feed
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// querySince is the query string holding the header timestamp of the last
+// feed seen by the client
+const querySince = "since"
+
+// defaultHistorySize is the number of feeds kept for the since query string
+const defaultHistorySize = 10
+
+// feedDataset is the full dataset of a backend publishing differential
+// feeds, rebuilt from its last FULL_DATASET and the DIFFERENTIAL feeds
+// received since. It lives as long as the backend handler, and is shared by
+// all of its requests.
+type feedDataset struct {
+	sync.Mutex
+	header   *pbproto.FeedHeader
+	entities []*pbproto.FeedEntity
+	// Position of every entity in entities, by id
+	index map[string]int
+}
+
+func newFeedDataset() *feedDataset {
+	return &feedDataset{index: map[string]int{}}
+}
+
+// update applies a feed onto the dataset and returns a copy of the resulting
+// full dataset. A FULL_DATASET replaces the entities, a DIFFERENTIAL one adds
+// or replaces the entities it holds and removes the deleted ones. Feeds older
+// than the dataset, such as the ones of concurrent requests answered out of
+// order, are not applied.
+func (d *feedDataset) update(feed *pbproto.FeedMessage, l requestLogger) *pbproto.FeedMessage {
+	d.Lock()
+	defer d.Unlock()
+
+	ts := feed.GetHeader().GetTimestamp()
+	switch {
+	case d.header != nil && ts != 0 && ts < d.header.GetTimestamp():
+		l.Debug(fmt.Sprintf("Ignoring a feed from %d, older than the dataset from %d", ts, d.header.GetTimestamp()))
+	case feed.GetHeader().GetIncrementality() == pbproto.FeedHeader_DIFFERENTIAL:
+		if d.header == nil {
+			l.Warning("Applying a differential feed without any full dataset received")
+		}
+		d.applyDifferential(feed.GetEntity())
+		d.setHeader(feed.GetHeader())
+	default:
+		d.applyFull(feed.GetEntity())
+		d.setHeader(feed.GetHeader())
+	}
+
+	l.Debug(fmt.Sprintf("Dataset holds %d entities", len(d.entities)))
+	full := &pbproto.FeedMessage{Header: d.header, Entity: d.entities}
+	return proto.Clone(full).(*pbproto.FeedMessage)
+}
+
+// applyFull replaces the entities by the ones of a FULL_DATASET, kept as
+// they are even when their ids are empty or shared
+func (d *feedDataset) applyFull(entities []*pbproto.FeedEntity) {
+	d.entities = append([]*pbproto.FeedEntity(nil), entities...)
+	d.reindex()
+}
+
+// applyDifferential adds or replaces the entities, keyed by id, and removes
+// the ones marked as deleted. Entities without an id cannot be told apart, so
+// they are always added, and their deletions ignored.
+func (d *feedDataset) applyDifferential(entities []*pbproto.FeedEntity) {
+	deleted := false
+	for _, e := range entities {
+		id := e.GetId()
+		i, ok := d.index[id]
+		switch {
+		case id == "" && e.GetIsDeleted():
+		case id == "":
+			d.entities = append(d.entities, e)
+		case e.GetIsDeleted():
+			if ok {
+				d.entities[i] = nil
+				delete(d.index, id)
+				deleted = true
+			}
+		case ok:
+			d.entities[i] = e
+		default:
+			d.index[id] = len(d.entities)
+			d.entities = append(d.entities, e)
+		}
+	}
+	if !deleted {
+		return
+	}
+
+	kept := d.entities[:0]
+	for _, e := range d.entities {
+		if e != nil {
+			kept = append(kept, e)
+		}
+	}
+	for i := len(kept); i < len(d.entities); i++ {
+		d.entities[i] = nil
+	}
+	d.entities = kept
+	d.reindex()
+}
+
+// reindex rebuilds the position of the entities by id. Of the entities
+// sharing an id, the last one is the one a DIFFERENTIAL feed replaces or
+// deletes.
+func (d *feedDataset) reindex() {
+	d.index = make(map[string]int, len(d.entities))
+	for i, e := range d.entities {
+		if id := e.GetId(); id != "" {
+			d.index[id] = i
+		}
+	}
+}
+
+// setHeader keeps the header of the last feed applied, which describes a full
+// dataset once applied
+func (d *feedDataset) setHeader(h *pbproto.FeedHeader) {
+	header := &pbproto.FeedHeader{}
+	if h != nil {
+		header = proto.Clone(h).(*pbproto.FeedHeader)
+	}
+	header.Incrementality = pbproto.FeedHeader_FULL_DATASET.Enum()
+	d.header = header
+}
+
+// feedHistory keeps the last feeds of a backend, by header timestamp, for
+// clients to get the changes since the one they last saw
+type feedHistory struct {
+	sync.Mutex
+	size int
+	// Oldest first, with increasing timestamps
+	feeds []*pbproto.FeedMessage
+}
+
+func newFeedHistory(size int) *feedHistory {
+	return &feedHistory{size: size}
+}
+
+// parseSince reads the timestamp of the feed the client last saw, 0 when it
+// is not given
+func parseSince(q url.Values) (uint64, error) {
+	v := q.Get(querySince)
+	if v == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, invalidQuery(querySince, err)
+	}
+	return since, nil
+}
+
+// record keeps a copy of a feed. Feeds without a timestamp cannot be asked
+// for, and the ones older than the last feed kept are out of order, so
+// neither is kept. A feed with the same timestamp replaces the last one.
+func (h *feedHistory) record(feed *pbproto.FeedMessage) {
+	ts := feed.GetHeader().GetTimestamp()
+	if ts == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if n := len(h.feeds); n > 0 {
+		last := h.feeds[n-1].GetHeader().GetTimestamp()
+		if ts < last {
+			return
+		}
+		if ts == last {
+			h.feeds[n-1] = proto.Clone(feed).(*pbproto.FeedMessage)
+			return
+		}
+	}
+	h.feeds = append(h.feeds, proto.Clone(feed).(*pbproto.FeedMessage))
+	if len(h.feeds) > h.size {
+		h.feeds = h.feeds[len(h.feeds)-h.size:]
+	}
+}
+
+// find returns the feed kept with the given timestamp, nil if there is none
+func (h *feedHistory) find(ts uint64) *pbproto.FeedMessage {
+	h.Lock()
+	defer h.Unlock()
+	for _, feed := range h.feeds {
+		if feed.GetHeader().GetTimestamp() == ts {
+			return feed
+		}
+	}
+	return nil
+}
+
+// changesSince turns a feed into a DIFFERENTIAL one holding the entities
+// added or changed since the feed with the given timestamp, and a deleted
+// entity for each of its entities that is gone. The entities of the older
+// feed are selected with the same filter, so an entity leaving the selection
+// is deleted as well. When that feed is no longer kept, the full feed is
+// returned as it is.
+func (h *feedHistory) changesSince(feed *pbproto.FeedMessage, since uint64, ef entityFilter, l requestLogger) *pbproto.FeedMessage {
+	base := h.find(since)
+	if base == nil {
+		l.Debug(fmt.Sprintf("No feed from %d kept, serving the full dataset", since))
+		return feed
+	}
+
+	previous := map[string]*pbproto.FeedEntity{}
+	for _, e := range base.GetEntity() {
+		if ef.match(e) {
+			previous[e.GetId()] = e
+		}
+	}
+
+	changes := &pbproto.FeedMessage{Header: proto.Clone(feed.GetHeader()).(*pbproto.FeedHeader)}
+	if changes.Header == nil {
+		changes.Header = &pbproto.FeedHeader{}
+	}
+	changes.Header.Incrementality = pbproto.FeedHeader_DIFFERENTIAL.Enum()
+
+	current := map[string]bool{}
+	for _, e := range feed.GetEntity() {
+		current[e.GetId()] = true
+		if old, ok := previous[e.GetId()]; !ok || !proto.Equal(old, e) {
+			changes.Entity = append(changes.Entity, e)
+		}
+	}
+	for _, e := range base.GetEntity() {
+		if _, ok := previous[e.GetId()]; ok && !current[e.GetId()] {
+			changes.Entity = append(changes.Entity, &pbproto.FeedEntity{
+				Id:        proto.String(e.GetId()),
+				IsDeleted: proto.Bool(true),
+			})
+		}
+	}
+
+	l.Debug(fmt.Sprintf("%d entities changed since %d", len(changes.Entity), since))
+	return changes
+}
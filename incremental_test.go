@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// testEntity builds a vehicle entity whose label tells its versions apart
+func testEntity(id, label string) *pbproto.FeedEntity {
+	return &pbproto.FeedEntity{
+		Id: proto.String(id),
+		Vehicle: &pbproto.VehiclePosition{
+			Vehicle: &pbproto.VehicleDescriptor{Label: proto.String(label)},
+		},
+	}
+}
+
+func deletedEntity(id string) *pbproto.FeedEntity {
+	return &pbproto.FeedEntity{Id: proto.String(id), IsDeleted: proto.Bool(true)}
+}
+
+func fullFeed(ts uint64, entities ...*pbproto.FeedEntity) *pbproto.FeedMessage {
+	return &pbproto.FeedMessage{
+		Header: &pbproto.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      pbproto.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(ts),
+		},
+		Entity: entities,
+	}
+}
+
+func differentialFeed(ts uint64, entities ...*pbproto.FeedEntity) *pbproto.FeedMessage {
+	feed := fullFeed(ts, entities...)
+	feed.Header.Incrementality = pbproto.FeedHeader_DIFFERENTIAL.Enum()
+	return feed
+}
+
+// entityKeys lists the entities of a feed as id:label, or id:deleted
+func entityKeys(feed *pbproto.FeedMessage) []string {
+	keys := []string{}
+	for _, e := range feed.GetEntity() {
+		if e.GetIsDeleted() {
+			keys = append(keys, e.GetId()+":deleted")
+			continue
+		}
+		keys = append(keys, e.GetId()+":"+e.GetVehicle().GetVehicle().GetLabel())
+	}
+	return keys
+}
+
+func TestFeedDatasetUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		feeds     []*pbproto.FeedMessage
+		entities  []string
+		timestamp uint64
+	}{
+		{
+			name:      "full dataset",
+			feeds:     []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"), testEntity("b", "1"))},
+			entities:  []string{"a:1", "b:1"},
+			timestamp: 10,
+		},
+		{
+			name: "full dataset replaces the entities",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("b", "1")),
+				fullFeed(20, testEntity("c", "1")),
+			},
+			entities:  []string{"c:1"},
+			timestamp: 20,
+		},
+		{
+			name: "differential adds and replaces",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("b", "1")),
+				differentialFeed(20, testEntity("b", "2"), testEntity("c", "1")),
+			},
+			entities:  []string{"a:1", "b:2", "c:1"},
+			timestamp: 20,
+		},
+		{
+			name: "differential deletes",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("b", "1"), testEntity("c", "1")),
+				differentialFeed(20, deletedEntity("b")),
+			},
+			entities:  []string{"a:1", "c:1"},
+			timestamp: 20,
+		},
+		{
+			name: "deleted then added again",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("b", "1")),
+				differentialFeed(20, deletedEntity("a")),
+				differentialFeed(30, testEntity("a", "2")),
+			},
+			entities:  []string{"b:1", "a:2"},
+			timestamp: 30,
+		},
+		{
+			name: "full, differential and delete sequence",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("b", "1")),
+				differentialFeed(20, testEntity("c", "1")),
+				differentialFeed(30, deletedEntity("a"), testEntity("b", "2")),
+				differentialFeed(40, deletedEntity("c"), testEntity("d", "1")),
+			},
+			entities:  []string{"b:2", "d:1"},
+			timestamp: 40,
+		},
+		{
+			name: "deleting an unknown entity",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1")),
+				differentialFeed(20, deletedEntity("z")),
+			},
+			entities:  []string{"a:1"},
+			timestamp: 20,
+		},
+		{
+			name: "full dataset after differentials",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1")),
+				differentialFeed(20, testEntity("b", "1")),
+				fullFeed(30, testEntity("c", "1")),
+			},
+			entities:  []string{"c:1"},
+			timestamp: 30,
+		},
+		{
+			name:      "differential without a full dataset",
+			feeds:     []*pbproto.FeedMessage{differentialFeed(10, testEntity("a", "1"))},
+			entities:  []string{"a:1"},
+			timestamp: 10,
+		},
+		{
+			name: "older feeds are ignored",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(20, testEntity("a", "1")),
+				fullFeed(10, testEntity("b", "1")),
+				differentialFeed(15, deletedEntity("a")),
+			},
+			entities:  []string{"a:1"},
+			timestamp: 20,
+		},
+		{
+			name:      "full dataset with entities without id",
+			feeds:     []*pbproto.FeedMessage{fullFeed(10, testEntity("", "1"), testEntity("", "2"))},
+			entities:  []string{":1", ":2"},
+			timestamp: 10,
+		},
+		{
+			name:      "full dataset with a duplicate id",
+			feeds:     []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"), testEntity("a", "2"))},
+			entities:  []string{"a:1", "a:2"},
+			timestamp: 10,
+		},
+		{
+			name: "differential replacing a duplicate id",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("a", "2")),
+				differentialFeed(20, testEntity("a", "3")),
+			},
+			entities:  []string{"a:1", "a:3"},
+			timestamp: 20,
+		},
+		{
+			name: "deletion without id",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("", "1"), testEntity("b", "1")),
+				differentialFeed(20, deletedEntity("")),
+			},
+			entities:  []string{":1", "b:1"},
+			timestamp: 20,
+		},
+		{
+			name: "differential with entities without id",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1")),
+				differentialFeed(20, testEntity("", "1"), testEntity("", "2")),
+			},
+			entities:  []string{"a:1", ":1", ":2"},
+			timestamp: 20,
+		},
+		{
+			name: "deletion next to an entity without id",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1"), testEntity("", "1"), testEntity("b", "1")),
+				differentialFeed(20, deletedEntity("a")),
+				differentialFeed(30, testEntity("b", "2")),
+			},
+			entities:  []string{":1", "b:2"},
+			timestamp: 30,
+		},
+		{
+			name: "feeds without a timestamp are applied",
+			feeds: []*pbproto.FeedMessage{
+				fullFeed(20, testEntity("a", "1")),
+				differentialFeed(0, testEntity("b", "1")),
+			},
+			entities:  []string{"a:1", "b:1"},
+			timestamp: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newFeedDataset()
+			var got *pbproto.FeedMessage
+			for _, feed := range tc.feeds {
+				got = d.update(feed, newLogger(""))
+			}
+
+			if keys := entityKeys(got); fmt.Sprint(keys) != fmt.Sprint(tc.entities) {
+				t.Errorf("entities: got %v, want %v", keys, tc.entities)
+			}
+			if ts := got.GetHeader().GetTimestamp(); ts != tc.timestamp {
+				t.Errorf("header timestamp: got %d, want %d", ts, tc.timestamp)
+			}
+			if inc := got.GetHeader().GetIncrementality(); inc != pbproto.FeedHeader_FULL_DATASET {
+				t.Errorf("header incrementality: got %s, want FULL_DATASET", inc)
+			}
+		})
+	}
+}
+
+func TestFeedDatasetUpdateReturnsACopy(t *testing.T) {
+	d := newFeedDataset()
+	got := d.update(fullFeed(10, testEntity("a", "1")), newLogger(""))
+	got.Entity[0].Id = proto.String("changed")
+	got.Entity = append(got.Entity, testEntity("b", "1"))
+	got.Header.Timestamp = proto.Uint64(99)
+
+	again := d.update(differentialFeed(10), newLogger(""))
+	if keys := entityKeys(again); fmt.Sprint(keys) != "[a:1]" {
+		t.Errorf("entities: got %v, want [a:1]", keys)
+	}
+	if ts := again.GetHeader().GetTimestamp(); ts != 10 {
+		t.Errorf("header timestamp: got %d, want 10", ts)
+	}
+}
+
+func TestFeedDatasetConcurrentUpdates(t *testing.T) {
+	const workers, feeds = 8, 50
+
+	d := newFeedDataset()
+	d.update(fullFeed(1), newLogger(""))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < feeds; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				// Every entity is added, then the previous one of the worker
+				// deleted, so each worker ends with its last one
+				entities := []*pbproto.FeedEntity{testEntity(id, "1")}
+				if i > 0 {
+					entities = append(entities, deletedEntity(fmt.Sprintf("%d-%d", w, i-1)))
+				}
+				got := d.update(differentialFeed(0, entities...), newLogger(""))
+				// The copies served are changed by the requests
+				prefixEntityIDs(got, "x:")
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	got := d.update(differentialFeed(0), newLogger(""))
+	if n := len(got.GetEntity()); n != workers {
+		t.Fatalf("got %d entities, want %d: %v", n, workers, entityKeys(got))
+	}
+	for _, e := range got.GetEntity() {
+		var w int
+		if _, err := fmt.Sscanf(e.GetId(), "%d-", &w); err != nil {
+			t.Fatalf("unexpected entity id %q", e.GetId())
+		}
+		if want := fmt.Sprintf("%d-%d", w, feeds-1); e.GetId() != want {
+			t.Errorf("worker %d: got entity %q, want %q", w, e.GetId(), want)
+		}
+	}
+}
+
+// tripEntity builds a vehicle entity serving a trip
+func tripEntity(id, tripID, label string) *pbproto.FeedEntity {
+	e := testEntity(id, label)
+	e.Vehicle.Trip = &pbproto.TripDescriptor{TripId: proto.String(tripID)}
+	return e
+}
+
+func TestFeedHistoryChangesSince(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int
+		history []*pbproto.FeedMessage
+		feed    *pbproto.FeedMessage
+		since   uint64
+		query   url.Values
+		// Entities served, nil for the feed itself
+		entities []string
+	}{
+		{
+			name:     "added",
+			history:  []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"))},
+			feed:     fullFeed(20, testEntity("a", "1"), testEntity("b", "1")),
+			since:    10,
+			entities: []string{"b:1"},
+		},
+		{
+			name:     "changed",
+			history:  []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"), testEntity("b", "1"))},
+			feed:     fullFeed(20, testEntity("a", "2"), testEntity("b", "1")),
+			since:    10,
+			entities: []string{"a:2"},
+		},
+		{
+			name:     "deleted",
+			history:  []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"), testEntity("b", "1"))},
+			feed:     fullFeed(20, testEntity("a", "1")),
+			since:    10,
+			entities: []string{"b:deleted"},
+		},
+		{
+			name:     "added, changed and deleted",
+			history:  []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"), testEntity("b", "1"))},
+			feed:     fullFeed(20, testEntity("a", "2"), testEntity("c", "1")),
+			since:    10,
+			entities: []string{"a:2", "c:1", "b:deleted"},
+		},
+		{
+			name:     "unchanged",
+			history:  []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"))},
+			feed:     fullFeed(20, testEntity("a", "1")),
+			since:    10,
+			entities: []string{},
+		},
+		{
+			name: "since an older feed kept",
+			history: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1")),
+				fullFeed(15, testEntity("a", "2"), testEntity("b", "1")),
+			},
+			feed:     fullFeed(20, testEntity("a", "2"), testEntity("b", "1")),
+			since:    10,
+			entities: []string{"a:2", "b:1"},
+		},
+		{
+			name:    "unknown since",
+			history: []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1"))},
+			feed:    fullFeed(20, testEntity("a", "1"), testEntity("b", "1")),
+			since:   12,
+		},
+		{
+			name: "evicted since",
+			size: 2,
+			history: []*pbproto.FeedMessage{
+				fullFeed(10, testEntity("a", "1")),
+				fullFeed(15, testEntity("a", "2")),
+				fullFeed(20, testEntity("a", "3")),
+			},
+			feed:  fullFeed(20, testEntity("a", "3")),
+			since: 10,
+		},
+		{
+			name: "entities leaving the selection",
+			history: []*pbproto.FeedMessage{
+				fullFeed(10, tripEntity("a", "t1", "1"), tripEntity("b", "t1", "1"), tripEntity("c", "t2", "1")),
+			},
+			// Filtered as prepareFeed does before asking for the changes
+			feed:     fullFeed(20, tripEntity("b", "t1", "2")),
+			since:    10,
+			query:    url.Values{queryTripID: {"t1"}},
+			entities: []string{"b:2", "a:deleted"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			size := tc.size
+			if size == 0 {
+				size = defaultHistorySize
+			}
+			h := newFeedHistory(size)
+			for _, feed := range tc.history {
+				h.record(feed)
+			}
+			ef, err := parseEntityFilter(tc.query, FilterConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := h.changesSince(tc.feed, tc.since, ef, newLogger(""))
+			if tc.entities == nil {
+				if got != tc.feed {
+					t.Fatalf("got the changes %v, want the full feed", entityKeys(got))
+				}
+				return
+			}
+
+			if keys := entityKeys(got); fmt.Sprint(keys) != fmt.Sprint(tc.entities) {
+				t.Errorf("entities: got %v, want %v", keys, tc.entities)
+			}
+			if inc := got.GetHeader().GetIncrementality(); inc != pbproto.FeedHeader_DIFFERENTIAL {
+				t.Errorf("header incrementality: got %s, want DIFFERENTIAL", inc)
+			}
+			if ts := got.GetHeader().GetTimestamp(); ts != tc.feed.GetHeader().GetTimestamp() {
+				t.Errorf("header timestamp: got %d, want %d", ts, tc.feed.GetHeader().GetTimestamp())
+			}
+			if inc := tc.feed.GetHeader().GetIncrementality(); inc != pbproto.FeedHeader_FULL_DATASET {
+				t.Errorf("the header of the feed was changed to %s", inc)
+			}
+		})
+	}
+}
+
+func TestFeedHistoryRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		feeds  []*pbproto.FeedMessage
+		kept   []uint64
+		labels map[uint64]string
+	}{
+		{
+			name:  "increasing timestamps",
+			feeds: []*pbproto.FeedMessage{fullFeed(10), fullFeed(20), fullFeed(30)},
+			kept:  []uint64{10, 20, 30},
+		},
+		{
+			name:  "trimmed to the size",
+			feeds: []*pbproto.FeedMessage{fullFeed(10), fullFeed(20), fullFeed(30), fullFeed(40)},
+			kept:  []uint64{20, 30, 40},
+		},
+		{
+			name:  "out of order feeds are not kept",
+			feeds: []*pbproto.FeedMessage{fullFeed(10), fullFeed(30), fullFeed(20)},
+			kept:  []uint64{10, 30},
+		},
+		{
+			name:  "feeds without a timestamp are not kept",
+			feeds: []*pbproto.FeedMessage{fullFeed(10), fullFeed(0)},
+			kept:  []uint64{10},
+		},
+		{
+			name:   "same timestamp replaces the last feed",
+			feeds:  []*pbproto.FeedMessage{fullFeed(10, testEntity("a", "1")), fullFeed(10, testEntity("a", "2"))},
+			kept:   []uint64{10},
+			labels: map[uint64]string{10: "[a:2]"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newFeedHistory(3)
+			for _, feed := range tc.feeds {
+				h.record(feed)
+			}
+
+			var kept []uint64
+			for _, feed := range h.feeds {
+				kept = append(kept, feed.GetHeader().GetTimestamp())
+			}
+			if fmt.Sprint(kept) != fmt.Sprint(tc.kept) {
+				t.Errorf("kept %v, want %v", kept, tc.kept)
+			}
+			for ts, want := range tc.labels {
+				if got := fmt.Sprint(entityKeys(h.find(ts))); got != want {
+					t.Errorf("feed %d: got %s, want %s", ts, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		since uint64
+		fails bool
+	}{
+		{query: "", since: 0},
+		{query: "since=1700000000", since: 1700000000},
+		{query: "since=-1", fails: true},
+		{query: "since=yesterday", fails: true},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		since, err := parseSince(q)
+		if (err != nil) != tc.fails {
+			t.Errorf("%q: got error %v, want failure %v", tc.query, err, tc.fails)
+			continue
+		}
+		if since != tc.since {
+			t.Errorf("%q: got %d, want %d", tc.query, since, tc.since)
+		}
+	}
+}
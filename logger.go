@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Logger is the interface of the KrakenD logger handed over to RegisterLogger
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warning(v ...interface{})
+	Error(v ...interface{})
+	Critical(v ...interface{})
+	Fatal(v ...interface{})
+}
+
+// logger is replaced by the KrakenD logger when the plugin is loaded, so the
+// plugin honours the level and prefix set in telemetry/logging
+var logger Logger = noopLogger{}
+
+// logPrefix identifies the plugin in the gateway logs
+var logPrefix = fmt.Sprintf("[PLUGIN: %s]", ClientRegisterer)
+
+// RegisterLogger is called by KrakenD before RegisterClients
+func (registerer) RegisterLogger(v interface{}) {
+	l, ok := v.(Logger)
+	if !ok {
+		return
+	}
+	logger = l
+	logger.Debug(logPrefix, "Logger loaded")
+}
+
+// requestLogger prepends the plugin prefix and a set of request-scoped fields
+// to every line it logs
+type requestLogger struct {
+	fields string
+}
+
+// newLogger returns a requestLogger with the given fields
+func newLogger(fields string) requestLogger {
+	return requestLogger{fields: logPrefix + fields}
+}
+
+// newRequestLogger tags the lines with the upstream request and, when the
+// client sent one, its request id. The query string is left out, as upstreams
+// often take their API key there.
+func newRequestLogger(req *http.Request) requestLogger {
+	fields := fmt.Sprintf("[%s %s]", req.Method, req.URL.Host+req.URL.Path)
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		fields += fmt.Sprintf("[request_id: %s]", id)
+	}
+	return newLogger(fields)
+}
+
+func (l requestLogger) Debug(v ...interface{})   { logger.Debug(l.with(v)...) }
+func (l requestLogger) Info(v ...interface{})    { logger.Info(l.with(v)...) }
+func (l requestLogger) Warning(v ...interface{}) { logger.Warning(l.with(v)...) }
+func (l requestLogger) Error(v ...interface{})   { logger.Error(l.with(v)...) }
+
+func (l requestLogger) with(v []interface{}) []interface{} {
+	return append([]interface{}{l.fields}, v...)
+}
+
+// noopLogger discards everything, it is used until KrakenD injects its logger
+type noopLogger struct{}
+
+func (noopLogger) Debug(_ ...interface{})    {}
+func (noopLogger) Info(_ ...interface{})     {}
+func (noopLogger) Warning(_ ...interface{})  {}
+func (noopLogger) Error(_ ...interface{})    {}
+func (noopLogger) Critical(_ ...interface{}) {}
+func (noopLogger) Fatal(_ ...interface{})    {}
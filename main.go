@@ -1,33 +1,392 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/luraproject/lura/v2/encoding"
-	"google.golang.org/protobuf/encoding/protojson"
+	"github.com/luraproject/lura/v2/proxy"
+	luragin "github.com/luraproject/lura/v2/router/gin"
 	"google.golang.org/protobuf/proto"
-	
+	"google.golang.org/protobuf/reflect/protoreflect"
+
 	// Import local proto package as pbproto to avoid name conflict
 	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
 )
 
-// Symbol exported by the plugin to comply with KrakenD plugin system
-var HandlerRegisterer = registerer("proto")
+// ClientRegisterer is the symbol the KrakenD http-client plugin loader looks up.
+// The name must match the "name" set in the "plugin/http-client" extra_config.
+var ClientRegisterer = registerer("krakend-pb-to-json")
 
 type registerer string
 
-// Plugin registration function that KrakenD calls to load plugin
-func (r registerer) RegisterHandlers(f func(
+// RegisterClients is called by KrakenD when the plugin is loaded
+func (r registerer) RegisterClients(f func(
 	name string,
-	handler func(interface{}, io.ReadCloser) (io.ReadCloser, error),
+	handler func(context.Context, map[string]interface{}) (http.Handler, error),
 )) {
-	f(string(r), r.registerProtoDecoder)
-	fmt.Fprintf(os.Stderr, "Proto decoder registered as '%s'\n", r)
+	f(string(r), r.registerClients)
+	logger.Debug(logPrefix, "Proto decoder registered as", string(r))
+}
+
+// registerClients builds the http.Handler that replaces the default KrakenD
+// http client for every backend configured with this plugin
+func (r registerer) registerClients(_ context.Context, extra map[string]interface{}) (http.Handler, error) {
+	// Check the passed configuration belongs to this plugin
+	name, ok := extra["name"].(string)
+	if !ok {
+		return nil, errors.New("wrong config: missing plugin name")
+	}
+	if name != string(r) {
+		return nil, fmt.Errorf("unknown register %s", name)
+	}
+
+	// Plugin settings are namespaced under the plugin name
+	raw, _ := extra[name].(map[string]interface{})
+	dec, err := newProtoDecoder(raw)
+	if err != nil {
+		// Lura only logs a warning when no handler is returned and falls back
+		// to its default client, so the backend would quietly serve the raw
+		// payload. It fails every request instead.
+		logger.Critical(logPrefix, "Every request of the backend will fail:", err.Error())
+		return invalidConfigHandler(err), nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l := newRequestLogger(req)
+
+		// Entities can be selected by the client, checked before going upstream
+		var ef entityFilter
+		if dec.cfg.Filters.Query {
+			var err error
+			if ef, err = parseEntityFilter(req.URL.Query(), dec.cfg.Filters); err != nil {
+				l.Warning("Rejecting request:", err.Error())
+				writeError(w, req, err)
+				return
+			}
+		}
+
+		// Clients polling for the changes since the last feed they saw
+		var since uint64
+		if dec.history != nil {
+			var err error
+			if since, err = parseSince(req.URL.Query()); err != nil {
+				l.Warning("Rejecting request:", err.Error())
+				writeError(w, req, err)
+				return
+			}
+		}
+
+		// Encode JSON request bodies to the protobuf the backend expects
+		if dec.reqType != nil {
+			if err := dec.encodeRequest(req); err != nil {
+				l.Warning("Rejecting request body:", err.Error())
+				writeError(w, req, err)
+				return
+			}
+		}
+
+		// Perform the upstream request ourselves, as the default client is replaced
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			// The error quotes the URL, whose query string may hold an API key
+			var ue *url.Error
+			if errors.As(err, &ue) {
+				ue.URL = req.URL.Host + req.URL.Path
+			}
+			l.Error("Upstream request failed:", err.Error())
+			writeError(w, req, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		// Upstream errors are forwarded untouched so KrakenD can handle them
+		if resp.StatusCode >= http.StatusBadRequest {
+			l.Debug("Forwarding upstream error status", resp.StatusCode)
+			for k, vs := range resp.Header {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		// Streams are decoded one message at a time
+		if dec.cfg.InputFormat == inputFormatDelimited {
+			r.streamDelimited(w, req, resp, dec, l)
+			return
+		}
+
+		data, err := readBody(resp, dec.cfg)
+		if err != nil {
+			l.Error("Reading upstream payload:", err.Error())
+			writeError(w, req, err)
+			return
+		}
+
+		// Decode the protobuf body into JSON
+		body, err := r.registerProtoDecoder(dec, l, ef, since, w.Header(), io.NopCloser(bytes.NewReader(data)))
+		if err != nil {
+			var de *decodeError
+			if errors.As(err, &de) && de.Code == errCodeInvalidPayload && dec.cfg.ErrorMode == errorModePassthrough {
+				// Forward the original payload so the client can decode it itself
+				copyHeaders(w.Header(), resp.Header)
+				w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+				w.WriteHeader(resp.StatusCode)
+				w.Write(data)
+				return
+			}
+			writeError(w, req, err)
+			return
+		}
+		defer body.Close()
+
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Set("Content-Type", dec.contentType())
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, body)
+	}), nil
+}
+
+// protoDecoder holds everything needed to decode the payloads of a backend,
+// resolved once at startup rather than on every request
+type protoDecoder struct {
+	cfg     Config
+	msgType protoreflect.MessageType
+	mask    fieldMask
+	// JSON key of the repeated field holding the collection items
+	itemsKey string
+	// Message the JSON request bodies are encoded to, nil to forward them as is
+	reqType protoreflect.MessageType
+	// Full dataset rebuilt from differential feeds, nil unless configured
+	dataset *feedDataset
+	// Last feeds served, for the since query string, nil unless configured
+	history *feedHistory
+	// Timestamp fields rendered as RFC 3339 strings
+	timestamps timestampFields
+}
+
+// invalidConfigHandler answers every request of a backend whose configuration
+// cannot be loaded with a 500 error, logging the problems along with the
+// backend the request was meant for
+func invalidConfigHandler(err error) http.Handler {
+	de := newDecodeError(http.StatusInternalServerError, errCodeInvalidConfig, "Invalid plugin configuration", err)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		newRequestLogger(req).Error("Invalid plugin configuration:", err.Error())
+		writeError(w, req, de)
+	})
+}
+
+// newProtoDecoder parses the plugin config and loads the schema it points to
+func newProtoDecoder(raw map[string]interface{}) (protoDecoder, error) {
+	cfg, err := parseConfig(raw)
+	if err != nil {
+		return protoDecoder{}, err
+	}
+
+	dec := protoDecoder{cfg: cfg}
+	if cfg.Request.MessageType != "" {
+		dec.reqType, err = loadMessageType(cfg.requestSchema())
+		if err != nil {
+			return protoDecoder{}, fmt.Errorf("request.message_type: %w", err)
+		}
+	}
+
+	// Raw payloads are walked without any schema
+	if cfg.DecodeMode == decodeModeRaw {
+		return dec, nil
+	}
+
+	dec.msgType, err = loadMessageType(cfg.schema())
+	if err != nil {
+		return protoDecoder{}, fmt.Errorf("loading schema: %w", err)
+	}
+	registerRenderType(dec.msgType)
+
+	if keys := cfg.requiresFeedMessage(); len(keys) > 0 {
+		if err := checkFeedMessage(dec.msgType); err != nil {
+			return protoDecoder{}, fmt.Errorf("%s: %w", strings.Join(keys, ", "), err)
+		}
+	}
+	if cfg.Incremental.Apply {
+		dec.dataset = newFeedDataset()
+	}
+	if cfg.Incremental.Since {
+		dec.history = newFeedHistory(cfg.Incremental.History)
+	}
+
+	dec.mask, err = newFieldMask(dec.msgType.Descriptor(), cfg.Filters.Include, cfg.Marshal.UseProtoNames)
+	if err != nil {
+		return protoDecoder{}, fmt.Errorf("filters.include: %w", err)
+	}
+
+	dec.timestamps, err = newTimestampFields(dec.msgType.Descriptor(), cfg.Timestamps, cfg.Marshal.UseProtoNames)
+	if err != nil {
+		return protoDecoder{}, fmt.Errorf("timestamps: %w", err)
+	}
+
+	if cfg.Collection.Field != "" {
+		dec.itemsKey, err = collectionItemsKey(dec.msgType.Descriptor(), cfg.Collection.Field, cfg.Marshal.UseProtoNames)
+		if err != nil {
+			return protoDecoder{}, fmt.Errorf("collection.field: %w", err)
+		}
+	}
+	return dec, nil
+}
+
+// toJSON renders a decoded message with the given marshal settings, adding
+// its unknown fields, applying the field mask of the backend and formatting
+// its timestamps
+func (d protoDecoder) toJSON(message proto.Message, mc MarshalConfig) ([]byte, error) {
+	jsonData, err := mc.options().Marshal(message)
+	if err != nil || (len(d.mask) == 0 && !d.cfg.UnknownFields && len(d.timestamps.paths) == 0) {
+		return jsonData, err
+	}
+
+	doc, err := decodeJSON(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	if d.cfg.UnknownFields {
+		addUnknownFields(message.ProtoReflect(), doc, mc.UseProtoNames)
+	}
+	if len(d.mask) > 0 {
+		d.mask.apply(doc)
+	}
+	d.timestamps.apply(doc)
+
+	jsonData, err = json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return mc.reformat(jsonData)
+}
+
+// render builds the JSON output of a decoded message, as configured. The
+// transforms are built from the feed, which is set whenever one is configured.
+func (d protoDecoder) render(message proto.Message, feed *pbproto.FeedMessage) ([]byte, error) {
+	switch d.cfg.Transform {
+	case transformGeoJSON:
+		return geoJSON(feed, d.cfg.Marshal)
+	case transformStopTimes:
+		return stopTimes(feed, d.cfg.Table, d.cfg.Marshal.UseEnumNumbers)
+	}
+
+	jsonData, err := d.toJSON(message, d.cfg.Marshal)
+	if err == nil && d.cfg.Collection.enabled() {
+		jsonData, err = d.collect(jsonData)
+	}
+	return jsonData, err
+}
+
+// contentType returns the media type of the rendered payloads
+func (d protoDecoder) contentType() string {
+	if d.cfg.Transform == transformStopTimes {
+		return d.cfg.Table.contentType()
+	}
+	return "application/json"
+}
+
+// decodeJSON parses a JSON document for post-processing, keeping numbers as
+// they were written so 64-bit values are not rounded
+func decodeJSON(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// addJSONKey adds a key to a rendered JSON object, such as the reports of
+// the validation and staleness checks
+func addJSONKey(jsonData []byte, key string, value interface{}, mc MarshalConfig) ([]byte, error) {
+	v, err := decodeJSON(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot add %s to a JSON %T", key, v)
+	}
+	doc[key] = value
+	if jsonData, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	return mc.reformat(jsonData)
+}
+
+// openBody returns a reader over the upstream payload, decompressing it when
+// configured or detected. The flag reports whether it is decompressing.
+func openBody(resp *http.Response, cfg Config) (*bufio.Reader, bool, error) {
+	br := bufio.NewReader(resp.Body)
+
+	// A gzip stream can never be mistaken for protobuf: its first byte would
+	// be a field using the invalid wire type 7
+	gzipped := cfg.Compression == compressionGzip
+	if cfg.Compression == compressionAuto {
+		magic, _ := br.Peek(2)
+		gzipped = resp.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b})
+	}
+	if !gzipped {
+		return br, false, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, true, newDecodeError(http.StatusBadGateway, errCodeInvalidGzip, "Failed to decompress gzip payload", err)
+	}
+	return bufio.NewReader(gz), true, nil
+}
+
+// readBody reads the whole upstream payload, enforcing the size limit
+func readBody(resp *http.Response, cfg Config) ([]byte, error) {
+	br, gzipped, err := openBody(resp, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = br
+	if cfg.MaxBodySize > 0 {
+		body = io.LimitReader(body, cfg.MaxBodySize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		if gzipped {
+			return nil, newDecodeError(http.StatusBadGateway, errCodeInvalidGzip, "Failed to decompress gzip payload", err)
+		}
+		return nil, err
+	}
+	if cfg.MaxBodySize > 0 && int64(len(data)) > cfg.MaxBodySize {
+		return nil, newDecodeError(http.StatusRequestEntityTooLarge, errCodeTooLarge,
+			fmt.Sprintf("Payload exceeds max_body_size of %d bytes", cfg.MaxBodySize), nil)
+	}
+	return data, nil
+}
+
+// copyHeaders copies the upstream headers, skipping the ones describing the
+// original body as they are no longer valid once it has been re-encoded
+func copyHeaders(dst, src http.Header) {
+	for k, vs := range src {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Content-Type", "Content-Encoding":
+			continue
+		}
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
 }
 
 // Utility min function
@@ -40,236 +399,287 @@ func min(a, b int) int {
 
 // The actual plugin handler that wraps our protobuf decoder
 func (r registerer) registerProtoDecoder(
-	cfg interface{},
+	dec protoDecoder,
+	l requestLogger,
+	ef entityFilter,
+	since uint64,
+	header http.Header,
 	resp io.ReadCloser,
 ) (io.ReadCloser, error) {
-	// Log plugin invocation
-	fmt.Fprintf(os.Stderr, "[DEBUG] Proto decoder plugin invoked with config: %+v\n", cfg)
-	
-	// Create a debug log file in the current working directory
-	homeDir, _ := os.UserHomeDir()
-	logFilePath := homeDir + "/krakend-proto-debug.log"
-	fmt.Fprintf(os.Stderr, "[DEBUG] Writing logs to %s\n", logFilePath)
-	
-	logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		defer logFile.Close()
-		fmt.Fprintf(logFile, "--- New request ---\n")
-		fmt.Fprintf(logFile, "Config: %+v\n", cfg)
-	} else {
-		fmt.Fprintf(os.Stderr, "[ERROR] Cannot create log file: %s\n", err.Error())
-	}
-	
+	cfg := dec.cfg
+
 	// Read all the response data
 	data, err := io.ReadAll(resp)
 	if err != nil {
-		errMsg := fmt.Sprintf("[ERROR] Reading protobuf data: %s\n", err.Error())
-		fmt.Fprintf(os.Stderr, errMsg)
-		if logFile != nil {
-			fmt.Fprintf(logFile, "%s\n", errMsg)
-		}
+		l.Error("Reading protobuf data:", err.Error())
 		return nil, err
 	}
-	
+
 	// Log data size and first few bytes for debugging
-	debugMsg := fmt.Sprintf("[DEBUG] Received %d bytes of protobuf data\n", len(data))
-	fmt.Fprintf(os.Stderr, debugMsg)
-	if logFile != nil {
-		fmt.Fprintf(logFile, "%s\n", debugMsg)
-		if len(data) > 0 {
-			fmt.Fprintf(logFile, "First 30 bytes: % x\n", data[:min(30, len(data))])
-		}
-	}
-	
+	l.Debug(fmt.Sprintf("Received %d bytes of protobuf data, first bytes: % x", len(data), data[:min(30, len(data))]))
+
 	// Handle empty response
 	if len(data) == 0 {
-		warnMsg := "[WARN] Empty protobuf response\n"
-		fmt.Fprintf(os.Stderr, warnMsg)
-		if logFile != nil {
-			fmt.Fprintf(logFile, "%s\n", warnMsg)
+		l.Warning("Empty protobuf response")
+		if cfg.Transform == transformNone {
+			return io.NopCloser(strings.NewReader("{}")), nil
 		}
-		return io.NopCloser(strings.NewReader("{}")), nil
-	}
-	
-	// Try to create an empty response directly for debugging
-	if logFile != nil {
-		fmt.Fprintf(logFile, "First attempting to return a simple JSON response for testing\n")
-	}
-	
-	// Debug: Return a static JSON response to test if the issue is with protobuf parsing
-	if true {  // Change to true to test static response
-		jsonResponse := `{"test": "This is a test response from the proto decoder plugin"}`
-		return io.NopCloser(strings.NewReader(jsonResponse)), nil
+		// The transforms render an empty feed in their own format
+		body, err := dec.render(nil, &pbproto.FeedMessage{})
+		if err != nil {
+			l.Error("Rendering an empty feed:", err.Error())
+			return nil, newDecodeError(http.StatusInternalServerError, errCodeMarshal, "Failed to convert protobuf to JSON", err)
+		}
+		return io.NopCloser(bytes.NewReader(body)), nil
 	}
-	
-	// Check if data starts with the protobuf magic number (not always present)
-	if len(data) > 4 && logFile != nil {
-		fmt.Fprintf(logFile, "Initial bytes check: %v\n", data[:4])
+
+	// Diagnostic modes that do not need the payload to be decoded
+	switch cfg.DebugMode {
+	case debugModeEchoStatic:
+		l.Debug("Returning the static debug response")
+		return io.NopCloser(strings.NewReader(staticDebugResponse)), nil
+	case debugModeDumpHex:
+		return debugResponse(cfg, data, nil, nil)
 	}
-	
-	// Create a new GTFS-realtime FeedMessage
-	message := &pbproto.FeedMessage{}
-	
-	// Unmarshal the protobuf data
-	if err := proto.Unmarshal(data, message); err != nil {
-		errMsg := fmt.Sprintf("[ERROR] Unmarshaling protobuf: %s\n", err.Error())
-		fmt.Fprintf(os.Stderr, errMsg)
-		if logFile != nil {
-			fmt.Fprintf(logFile, "%s\n", errMsg)
-			// Dump more raw data for debugging
-			if len(data) > 50 {
-				fmt.Fprintf(logFile, "First 50 bytes: % x\n", data[:50])
+
+	var jsonData []byte
+	if cfg.DecodeMode == decodeModeRaw {
+		// Without a schema, render the wire format as it is
+		fields, err := decodeWireFields(data)
+		if err != nil {
+			return dec.parseFailure(data, err, l)
+		}
+		jsonData, err = rawJSON(fields, cfg.Marshal)
+		if err != nil {
+			l.Error("Marshaling to JSON:", err.Error())
+			return nil, newDecodeError(http.StatusInternalServerError, errCodeMarshal, "Failed to convert protobuf to JSON", err)
+		}
+	} else {
+		// Create a new message of the configured type
+		message := dec.msgType.New().Interface()
+
+		// Unmarshal the protobuf data
+		if err := (proto.UnmarshalOptions{AllowPartial: cfg.Marshal.AllowPartial}).Unmarshal(data, message); err != nil {
+			return dec.parseFailure(data, err, l)
+		}
+
+		// The GTFS-realtime features work on the compiled FeedMessage, which
+		// the message is converted to once for the whole request
+		var feed *pbproto.FeedMessage
+		if dec.usesFeed() {
+			if feed, err = asFeedMessage(message); err != nil {
+				return dec.parseFailure(data, err, l)
+			}
+		}
+
+		// Check the feed as received, before it is processed
+		var report *validationReport
+		if cfg.Validation.Mode != validationModeOff {
+			report = validateFeed(feed, time.Now(), cfg.Validation)
+			if report.Errors > 0 {
+				l.Warning(fmt.Sprintf("Feed validation found %d errors and %d warnings: %s", report.Errors, report.Warnings, strings.Join(report.codes(), ", ")))
 			} else {
-				fmt.Fprintf(logFile, "All bytes: % x\n", data)
+				l.Debug(fmt.Sprintf("Feed validation found %d warnings", report.Warnings))
 			}
 		}
-		
-		// Return a friendly error response as JSON instead of failing
-		errorResponse := fmt.Sprintf(`{"error": "Failed to parse protobuf data", "details": "%s"}`, err.Error())
-		return io.NopCloser(strings.NewReader(errorResponse)), nil
-	}
-	
-	// Configure JSON marshaling options
-	marshaler := protojson.MarshalOptions{
-		UseProtoNames:   true,
-		EmitUnpopulated: true,
-	}
-	
-	// Convert protobuf to JSON
-	jsonData, err := marshaler.Marshal(message)
-	if err != nil {
-		errMsg := fmt.Sprintf("[ERROR] Marshaling to JSON: %s\n", err.Error())
-		fmt.Fprintf(os.Stderr, errMsg)
-		if logFile != nil {
-			fmt.Fprintf(logFile, "%s\n", errMsg)
+
+		// Rebuild the full dataset from differential feeds first, so the age
+		// measured and the entities dropped are the ones of the same feed
+		if dec.dataset != nil {
+			feed = dec.dataset.update(feed, l)
 		}
-		// Return a friendly error response
-		errorResponse := fmt.Sprintf(`{"error": "Failed to convert protobuf to JSON", "details": "%s"}`, err.Error())
-		return io.NopCloser(strings.NewReader(errorResponse)), nil
-	}
-	
-	successMsg := "[DEBUG] Successfully decoded protobuf to JSON\n"
-	fmt.Fprintf(os.Stderr, successMsg)
-	if logFile != nil {
-		fmt.Fprintf(logFile, "%s\n", successMsg)
-		if len(jsonData) > 100 {
-			fmt.Fprintf(logFile, "First 100 chars of JSON: %s\n", jsonData[:100])
-		} else if len(jsonData) > 0 {
-			fmt.Fprintf(logFile, "JSON output: %s\n", jsonData)
+
+		// Measure the age of the feed, refusing the stale ones if configured
+		var staleness *stalenessReport
+		if maxAge := cfg.Staleness.maxAge(); maxAge > 0 {
+			staleness = checkStaleness(feed, time.Now(), maxAge)
+			staleness.setHeader(header)
+			if staleness.Stale {
+				l.Warning(fmt.Sprintf("Feed is %ds old, past the max_age of %s", *staleness.FeedAge, cfg.Staleness.MaxAge))
+				if cfg.Staleness.Action == stalenessFail {
+					return nil, newDecodeError(http.StatusServiceUnavailable, errCodeStaleFeed,
+						fmt.Sprintf("Feed is %ds old, past the max_age of %s", *staleness.FeedAge, cfg.Staleness.MaxAge), nil)
+				}
+			}
+		}
+
+		// Process the GTFS-realtime feeds as configured, then bring the
+		// result back to the message type of the backend, so the fields the
+		// compiled schema lacks are still rendered
+		if dec.processesFeed(ef) {
+			feed = dec.prepareFeed(feed, l, ef, since)
+			if message, err = dec.fromFeedMessage(feed); err != nil {
+				l.Error("Converting the processed feed:", err.Error())
+				return nil, newDecodeError(http.StatusInternalServerError, errCodeMarshal, "Failed to convert protobuf to JSON", err)
+			}
 		}
+
+		// Convert protobuf to JSON
+		switch cfg.Validation.Mode {
+		case validationModeReport:
+			jsonData, err = report.render(cfg.Marshal)
+		case validationModeAnnotate:
+			jsonData, err = dec.render(message, feed)
+			if err == nil {
+				jsonData, err = addJSONKey(jsonData, validationKey, report, cfg.Marshal)
+			}
+		default:
+			jsonData, err = dec.render(message, feed)
+		}
+		if err == nil && staleness != nil && cfg.Staleness.Action == stalenessAnnotate {
+			jsonData, err = addJSONKey(jsonData, stalenessKey, staleness, cfg.Marshal)
+		}
+		if err != nil {
+			l.Error("Marshaling to JSON:", err.Error())
+			return nil, newDecodeError(http.StatusInternalServerError, errCodeMarshal, "Failed to convert protobuf to JSON", err)
+		}
+	}
+
+	l.Debug(fmt.Sprintf("Decoded %s into %d bytes of JSON", dec.messageName(), len(jsonData)))
+
+	// Wrap the decoded JSON along with the raw bytes
+	if cfg.DebugMode == debugModeDumpBoth {
+		return debugResponse(cfg, data, jsonData, nil)
 	}
-	
+
 	// Return the JSON data as a ReadCloser
 	return io.NopCloser(bytes.NewReader(jsonData)), nil
 }
 
+// parseFailure reports a payload that is not valid protobuf, along with the raw
+// bytes in the dump-both debug mode
+func (d protoDecoder) parseFailure(data []byte, err error, l requestLogger) (io.ReadCloser, error) {
+	l.Error("Unmarshaling protobuf:", err.Error())
+
+	if d.cfg.DebugMode == debugModeDumpBoth {
+		return debugResponse(d.cfg, data, nil, err)
+	}
+
+	de := newDecodeError(http.StatusBadGateway, errCodeInvalidPayload, "Failed to parse protobuf data", err)
+	if d.msgType != nil {
+		de.Offset = findErrorOffset(d.msgType.Descriptor(), data)
+	}
+	return nil, de
+}
+
+// messageName names what the payloads are decoded as, for the logs
+func (d protoDecoder) messageName() string {
+	if d.msgType == nil {
+		return "raw wire format"
+	}
+	return string(d.msgType.Descriptor().FullName())
+}
+
+// debugResponse renders a debug dump with the configured JSON layout
+func debugResponse(cfg Config, data, decoded []byte, decodeErr error) (io.ReadCloser, error) {
+	dump, err := newDebugDump(cfg.DebugMode, data, decoded, decodeErr)
+	if err == nil {
+		dump, err = cfg.Marshal.reformat(dump)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(dump)), nil
+}
+
 // Legacy function kept for compatibility - now we're using the proper plugin approach
 func init() {
-    // Register our custom decoder factory under the name "proto"
-    encoding.GetRegister().Register("proto", func(bool) func(io.Reader, *map[string]interface{}) error {
-        return protobufDecoder
-    })
+	// Register our custom decoder factory under the name "proto"
+	encoding.GetRegister().Register("proto", func(bool) func(io.Reader, *map[string]interface{}) error {
+		return protobufDecoder
+	})
+
+	// And the collection variant, returning the FeedMessage entities
+	encoding.GetRegister().Register(protoCollectionEncoding, func(bool) func(io.Reader, *map[string]interface{}) error {
+		return newCollectionDecoder(defaultCollectionDecoder)
+	})
+
+	// Output renders serving the response back as binary protobuf
+	luragin.RegisterRender(protobufRenderEncoding, protobufRender)
+	luragin.RegisterRender(negotiatedRenderEncoding, negotiatedRender)
+
+	// Combiner merging the feeds of several backends into one
+	proxy.RegisterResponseCombiner(feedMergeCombiner, mergeFeeds)
 }
 
 // Adapted decoder function that complies with encoding.Decoder signature
 func protobufDecoder(r io.Reader, v *map[string]interface{}) error {
-    // Read the protobuf data
-    data, err := io.ReadAll(r)
-    if err != nil {
-        fmt.Printf("ERROR: Failed to read data: %v\n", err)
-        return err
-    }
-
-    // Log data size for debugging
-    fmt.Printf("DEBUG: Received %d bytes of protobuf data\n", len(data))
-    
-    // Handle empty response
-    if len(data) == 0 {
-        fmt.Printf("WARN: Empty response received\n")
-        *v = make(map[string]interface{})
-        return nil
-    }
-
-    // Create a new GTFS-realtime FeedMessage
-    message := &pbproto.FeedMessage{}
-
-    // Unmarshal the protobuf data
-    if err := proto.Unmarshal(data, message); err != nil {
-        fmt.Printf("ERROR: Failed to unmarshal protobuf: %v\n", err)
-        // Try to dump some raw data for debugging
-        if len(data) > 20 {
-            fmt.Printf("DEBUG: First 20 bytes: %v\n", data[:20])
-        } else {
-            fmt.Printf("DEBUG: Data: %v\n", data)
-        }
-        return fmt.Errorf("failed to unmarshal protobuf: %v", err)
-    }
-
-    // Configure JSON marshaling options
-    marshaler := protojson.MarshalOptions{
-        UseProtoNames:   true,
-        EmitUnpopulated: true,
-    }
-
-    // Convert protobuf to JSON
-    jsonData, err := marshaler.Marshal(message)
-    if err != nil {
-        fmt.Printf("ERROR: Failed to marshal to JSON: %v\n", err)
-        return fmt.Errorf("failed to marshal to JSON: %v", err)
-    }
-
-    // Parse JSON into map[string]interface{}
-    if err := json.Unmarshal(jsonData, v); err != nil {
-        fmt.Printf("ERROR: Failed to parse JSON: %v\n", err)
-        return fmt.Errorf("failed to parse JSON: %v", err)
-    }
-
-    fmt.Printf("DEBUG: Successfully decoded protobuf to JSON\n")
-    return nil
-}
+	l := newLogger("[ENCODING: proto]")
+
+	// Read the protobuf data
+	data, err := io.ReadAll(r)
+	if err != nil {
+		l.Error("Failed to read data:", err.Error())
+		return err
+	}
 
+	// Log data size for debugging
+	l.Debug(fmt.Sprintf("Received %d bytes of protobuf data", len(data)))
+
+	// Handle empty response
+	if len(data) == 0 {
+		l.Warning("Empty response received")
+		*v = make(map[string]interface{})
+		return nil
+	}
+
+	// Create a new GTFS-realtime FeedMessage
+	message := defaultMessageType.New().Interface()
+
+	// Unmarshal the protobuf data
+	if err := proto.Unmarshal(data, message); err != nil {
+		l.Error("Failed to unmarshal protobuf:", err.Error())
+		l.Debug(fmt.Sprintf("First bytes: % x", data[:min(20, len(data))]))
+		de := newDecodeError(http.StatusBadGateway, errCodeInvalidPayload, "Failed to parse protobuf data", err)
+		de.Offset = findErrorOffset(defaultMessageType.Descriptor(), data)
+		return de
+	}
+
+	// Convert protobuf to JSON with the default options
+	jsonData, err := defaultConfig().Marshal.options().Marshal(message)
+	if err != nil {
+		l.Error("Failed to marshal to JSON:", err.Error())
+		return newDecodeError(http.StatusInternalServerError, errCodeMarshal, "Failed to convert protobuf to JSON", err)
+	}
+
+	// Parse JSON into map[string]interface{}
+	if err := json.Unmarshal(jsonData, v); err != nil {
+		l.Error("Failed to parse JSON:", err.Error())
+		return fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	l.Debug("Successfully decoded protobuf to JSON")
+	return nil
+}
 
 func main() {
-    // Simple testing function for local development
-    fmt.Println("KrakenD Protocol Buffer to JSON plugin loaded")
-    fmt.Println("This is a plugin and is not meant to be run directly.")
-    fmt.Println("Build with: go build -buildmode=plugin -o krakend-pb-to-json.so .")
-    
-    // Test function to verify plugin functionality
-    fmt.Println("\nRunning self-test...")
-    
-    // Create a test protobuf message
-    homeDir, _ := os.UserHomeDir()
-    logFile, _ := os.OpenFile(homeDir+"/krakend-plugin-test.log", os.O_CREATE|os.O_WRONLY, 0644)
-    if logFile != nil {
-        defer logFile.Close()
-        fmt.Fprintf(logFile, "Plugin self-test started\n")
-        
-        // Create a very simple example JSON response
-        testJSON := `{"test": "This is a test from the plugin's main function"}`
-        
-        // Create a reader with this JSON
-        jsonReader := strings.NewReader(testJSON)
-        
-        // Test if our plugin can handle this
-        fmt.Fprintf(logFile, "Creating plugin handler\n")
-        handler := HandlerRegisterer  // Already a registerer type
-        
-        // Create a mock ReadCloser
-        mockResponse := io.NopCloser(jsonReader)
-        
-        // Try to process it
-        fmt.Fprintf(logFile, "Calling plugin handler\n")
-        result, err := handler.registerProtoDecoder(nil, mockResponse)
-        
-        if err != nil {
-            fmt.Fprintf(logFile, "ERROR: %s\n", err)
-        } else if result != nil {
-            // Read the result
-            resultBytes, _ := io.ReadAll(result)
-            fmt.Fprintf(logFile, "SUCCESS: Got result: %s\n", string(resultBytes))
-        } else {
-            fmt.Fprintf(logFile, "ERROR: Nil result without error\n")
-        }
-    }
-}
\ No newline at end of file
+	// Simple testing function for local development
+	fmt.Println("KrakenD Protocol Buffer to JSON plugin loaded")
+	fmt.Println("This is a plugin and is not meant to be run directly.")
+	fmt.Println("Build with: go build -buildmode=plugin -o krakend-pb-to-json.so .")
+
+	// Test function to verify plugin functionality
+	fmt.Println("\nRunning self-test...")
+
+	// Create a test protobuf message
+	message := &pbproto.FeedMessage{
+		Header: &pbproto.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")},
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+
+	// Try to process it
+	dec := protoDecoder{cfg: defaultConfig(), msgType: defaultMessageType}
+	result, err := ClientRegisterer.registerProtoDecoder(dec, newLogger("[SELF-TEST]"), entityFilter{}, 0, http.Header{}, io.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+
+	// Read the result
+	resultBytes, _ := io.ReadAll(result)
+	fmt.Println("SUCCESS: Got result:", string(resultBytes))
+}
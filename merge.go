@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/v2/proxy"
+	"google.golang.org/protobuf/proto"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// feedMergeCombiner is the response combiner merging the GTFS-realtime feeds
+// of several backends into one, selected with the "combiner" key of the
+// endpoint proxy extra_config
+const feedMergeCombiner = "gtfs-merge"
+
+// JSON keys of the merged FeedMessage fields, under both naming styles
+const (
+	feedHeaderKey      = "header"
+	feedEntityKey      = "entity"
+	entityIDKey        = "id"
+	headerTimestampKey = "timestamp"
+	headerIncrementKey = "incrementality"
+	headerVersionKey   = "gtfs_realtime_version"
+	headerVersionJSON  = "gtfsRealtimeVersion"
+)
+
+// The DIFFERENTIAL incrementality, rendered by name or by number
+const (
+	differentialName    = "DIFFERENTIAL"
+	differentialNumeric = "1"
+)
+
+// prefixEntityIDs prepends a prefix to the id of every entity of a feed
+func prefixEntityIDs(feed *pbproto.FeedMessage, prefix string) {
+	if prefix == "" {
+		return
+	}
+	for _, e := range feed.GetEntity() {
+		e.Id = proto.String(prefix + e.GetId())
+	}
+}
+
+// mergeFeeds combines the decoded feeds of the backends of an endpoint. The
+// entities are concatenated, dropping the ones whose id has already been
+// merged, and the headers are merged by mergeHeaders. Other keys are merged
+// as the default lura combiner does, the last one winning.
+//
+// Lura merges the responses two at a time as they arrive, so the order of the
+// entities, and which of two entities sharing an id is kept, depends on which
+// backend answers first.
+func mergeFeeds(total int, parts []*proxy.Response) *proxy.Response {
+	isComplete := len(parts) == total
+	var merged *proxy.Response
+	for _, part := range parts {
+		if part == nil || part.Data == nil {
+			isComplete = false
+			continue
+		}
+		isComplete = isComplete && part.IsComplete
+		if merged == nil {
+			merged = &proxy.Response{Data: part.Data}
+			continue
+		}
+		for k, v := range part.Data {
+			switch k {
+			case feedEntityKey:
+				merged.Data[k] = mergeEntities(merged.Data[k], v)
+			case feedHeaderKey:
+				merged.Data[k] = mergeHeaders(merged.Data[k], v)
+			default:
+				merged.Data[k] = v
+			}
+		}
+	}
+
+	if merged == nil {
+		return &proxy.Response{Data: map[string]interface{}{}, IsComplete: isComplete}
+	}
+	merged.IsComplete = isComplete
+	return merged
+}
+
+// mergeEntities appends the entities of b to the ones of a, but for the ones
+// with an id already in a. Entities without an id are always kept.
+func mergeEntities(a, b interface{}) interface{} {
+	left, _ := a.([]interface{})
+	right, ok := b.([]interface{})
+	if !ok {
+		return a
+	}
+
+	seen := map[string]bool{}
+	entities := make([]interface{}, 0, len(left)+len(right))
+	for _, e := range left {
+		if id := entityID(e); id != "" {
+			seen[id] = true
+		}
+		entities = append(entities, e)
+	}
+	for _, e := range right {
+		id := entityID(e)
+		if id != "" && seen[id] {
+			continue
+		}
+		if id != "" {
+			seen[id] = true
+		}
+		entities = append(entities, e)
+	}
+	return entities
+}
+
+// entityID returns the id of a decoded entity, empty when it has none
+func entityID(e interface{}) string {
+	entity, _ := e.(map[string]interface{})
+	id, _ := entity[entityIDKey].(string)
+	return id
+}
+
+// mergeHeaders merges two decoded FeedHeaders. The merged feed is as old as
+// its oldest part, follows the most recent GTFS-realtime version used by any
+// part, and is differential when any part is. Other fields come from a.
+func mergeHeaders(a, b interface{}) interface{} {
+	left, _ := a.(map[string]interface{})
+	right, ok := b.(map[string]interface{})
+	if !ok {
+		return a
+	}
+	if left == nil {
+		return right
+	}
+
+	header := make(map[string]interface{}, len(left))
+	for k, v := range left {
+		header[k] = v
+	}
+
+	lt, lok := headerTimestamp(left[headerTimestampKey])
+	rt, rok := headerTimestamp(right[headerTimestampKey])
+	if rok && (!lok || rt < lt) {
+		header[headerTimestampKey] = right[headerTimestampKey]
+	}
+
+	for _, key := range []string{headerVersionKey, headerVersionJSON} {
+		rv, ok := right[key].(string)
+		if !ok {
+			continue
+		}
+		if lv, _ := left[key].(string); compareVersions(rv, lv) > 0 {
+			header[key] = rv
+		}
+	}
+
+	if isDifferential(right[headerIncrementKey]) {
+		header[headerIncrementKey] = right[headerIncrementKey]
+	}
+	return header
+}
+
+// headerTimestamp reads a decoded uint64 timestamp, rendered as a string by
+// protojson but possibly as a number once through a lura decoder. Unset
+// timestamps are reported as such.
+func headerTimestamp(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case nil:
+		return 0, false
+	case float64:
+		// fmt would render large numbers with an exponent
+		return uint64(n), n >= 1 && n < math.MaxUint64
+	}
+	ts, err := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+	return ts, err == nil && ts > 0
+}
+
+// isDifferential reports whether a decoded incrementality is DIFFERENTIAL,
+// whether it is rendered by name or by number
+func isDifferential(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	s := fmt.Sprint(v)
+	return s == differentialName || s == differentialNumeric
+}
+
+// compareVersions compares two dotted version numbers such as "2.0", the
+// parts that are not numbers counting as 0
+func compareVersions(a, b string) int {
+	ap, bp := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ap) || i < len(bp); i++ {
+		var x, y int
+		if i < len(ap) {
+			x, _ = strconv.Atoi(ap[i])
+		}
+		if i < len(bp) {
+			y, _ = strconv.Atoi(bp[i])
+		}
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+// decodedFeed builds a feed as rendered by protojson, with entities holding
+// only an id
+func decodedFeed(header map[string]interface{}, ids ...string) map[string]interface{} {
+	entities := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		entities = append(entities, map[string]interface{}{entityIDKey: id})
+	}
+	return map[string]interface{}{feedHeaderKey: header, feedEntityKey: entities}
+}
+
+// combinePairwise merges responses two at a time as they arrive, as the lura
+// merge middleware calls the combiner
+func combinePairwise(responses ...*proxy.Response) *proxy.Response {
+	var merged *proxy.Response
+	for _, r := range responses {
+		if merged == nil {
+			merged = r
+			continue
+		}
+		merged = mergeFeeds(2, []*proxy.Response{merged, r})
+	}
+	return merged
+}
+
+func TestMergeHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "oldest timestamp",
+			a:    map[string]interface{}{headerTimestampKey: "1700000100"},
+			b:    map[string]interface{}{headerTimestampKey: "1700000000"},
+			want: map[string]interface{}{headerTimestampKey: "1700000000"},
+		},
+		{
+			name: "oldest timestamp already on the left",
+			a:    map[string]interface{}{headerTimestampKey: "1700000000"},
+			b:    map[string]interface{}{headerTimestampKey: "1700000100"},
+			want: map[string]interface{}{headerTimestampKey: "1700000000"},
+		},
+		{
+			name: "numeric timestamps",
+			a:    map[string]interface{}{headerTimestampKey: float64(1700000100)},
+			b:    map[string]interface{}{headerTimestampKey: float64(1700000000)},
+			want: map[string]interface{}{headerTimestampKey: float64(1700000000)},
+		},
+		{
+			name: "unset timestamp on the left",
+			a:    map[string]interface{}{},
+			b:    map[string]interface{}{headerTimestampKey: "1700000000"},
+			want: map[string]interface{}{headerTimestampKey: "1700000000"},
+		},
+		{
+			name: "zero timestamp on the right",
+			a:    map[string]interface{}{headerTimestampKey: "1700000000"},
+			b:    map[string]interface{}{headerTimestampKey: "0"},
+			want: map[string]interface{}{headerTimestampKey: "1700000000"},
+		},
+		{
+			name: "highest version",
+			a:    map[string]interface{}{headerVersionKey: "1.0"},
+			b:    map[string]interface{}{headerVersionKey: "2.0"},
+			want: map[string]interface{}{headerVersionKey: "2.0"},
+		},
+		{
+			name: "highest version already on the left",
+			a:    map[string]interface{}{headerVersionKey: "2.0"},
+			b:    map[string]interface{}{headerVersionKey: "1.0"},
+			want: map[string]interface{}{headerVersionKey: "2.0"},
+		},
+		{
+			name: "versions compared as numbers",
+			a:    map[string]interface{}{headerVersionJSON: "1.9"},
+			b:    map[string]interface{}{headerVersionJSON: "1.10"},
+			want: map[string]interface{}{headerVersionJSON: "1.10"},
+		},
+		{
+			name: "named DIFFERENTIAL wins",
+			a:    map[string]interface{}{headerIncrementKey: "FULL_DATASET"},
+			b:    map[string]interface{}{headerIncrementKey: "DIFFERENTIAL"},
+			want: map[string]interface{}{headerIncrementKey: "DIFFERENTIAL"},
+		},
+		{
+			name: "named DIFFERENTIAL on the left",
+			a:    map[string]interface{}{headerIncrementKey: "DIFFERENTIAL"},
+			b:    map[string]interface{}{headerIncrementKey: "FULL_DATASET"},
+			want: map[string]interface{}{headerIncrementKey: "DIFFERENTIAL"},
+		},
+		{
+			name: "numeric DIFFERENTIAL wins",
+			a:    map[string]interface{}{headerIncrementKey: float64(0)},
+			b:    map[string]interface{}{headerIncrementKey: float64(1)},
+			want: map[string]interface{}{headerIncrementKey: float64(1)},
+		},
+		{
+			name: "numeric FULL_DATASET",
+			a:    map[string]interface{}{headerIncrementKey: float64(0)},
+			b:    map[string]interface{}{headerIncrementKey: float64(0)},
+			want: map[string]interface{}{headerIncrementKey: float64(0)},
+		},
+		{
+			name: "other fields from the left",
+			a:    map[string]interface{}{"feed_version": "a"},
+			b:    map[string]interface{}{"feed_version": "b"},
+			want: map[string]interface{}{"feed_version": "a"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeHeaders(tc.a, tc.b)
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeFeeds(t *testing.T) {
+	merged := combinePairwise(
+		&proxy.Response{IsComplete: true, Data: decodedFeed(map[string]interface{}{
+			headerVersionKey: "1.0", headerIncrementKey: "FULL_DATASET", headerTimestampKey: "1700000100",
+		}, "a", "b")},
+		&proxy.Response{IsComplete: true, Data: decodedFeed(map[string]interface{}{
+			headerVersionKey: "2.0", headerIncrementKey: "FULL_DATASET", headerTimestampKey: "1700000000",
+		}, "b", "c")},
+		&proxy.Response{IsComplete: true, Data: decodedFeed(map[string]interface{}{
+			headerVersionKey: "1.0", headerIncrementKey: "DIFFERENTIAL", headerTimestampKey: "1700000200",
+		}, "d", "a")},
+	)
+
+	if !merged.IsComplete {
+		t.Error("the merged feed is not complete")
+	}
+	var ids []string
+	for _, e := range merged.Data[feedEntityKey].([]interface{}) {
+		ids = append(ids, entityID(e))
+	}
+	if fmt.Sprint(ids) != "[a b c d]" {
+		t.Errorf("entities: got %v, want [a b c d]", ids)
+	}
+	want := map[string]interface{}{
+		headerVersionKey: "2.0", headerIncrementKey: "DIFFERENTIAL", headerTimestampKey: "1700000000",
+	}
+	if fmt.Sprint(merged.Data[feedHeaderKey]) != fmt.Sprint(want) {
+		t.Errorf("header: got %v, want %v", merged.Data[feedHeaderKey], want)
+	}
+}
+
+func TestMergeFeedsIsComplete(t *testing.T) {
+	part := func(complete bool) *proxy.Response {
+		return &proxy.Response{IsComplete: complete, Data: decodedFeed(map[string]interface{}{})}
+	}
+	for _, tc := range []struct {
+		name  string
+		parts []*proxy.Response
+		want  bool
+	}{
+		{name: "all complete", parts: []*proxy.Response{part(true), part(true), part(true)}, want: true},
+		{name: "first incomplete", parts: []*proxy.Response{part(false), part(true), part(true)}},
+		{name: "middle incomplete", parts: []*proxy.Response{part(true), part(false), part(true)}},
+		{name: "last incomplete", parts: []*proxy.Response{part(true), part(true), part(false)}},
+		{name: "no data", parts: []*proxy.Response{part(true), {IsComplete: true}, part(true)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := combinePairwise(tc.parts...).IsComplete; got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	// A missing part, as when a backend fails before lura combines the others
+	if mergeFeeds(3, []*proxy.Response{part(true), part(true)}).IsComplete {
+		t.Error("got a complete feed with a missing part")
+	}
+	if got := mergeFeeds(2, []*proxy.Response{nil, part(true)}); got.IsComplete {
+		t.Error("got a complete feed with a nil part")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	luragin "github.com/luraproject/lura/v2/router/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// negotiatedRenderEncoding is the endpoint output_encoding serving protobuf
+// to the clients asking for it and negotiating the other formats as the lura
+// "negotiate" output encoding does
+const negotiatedRenderEncoding = "negotiate-protobuf"
+
+// protobufRenderEncoding is the endpoint output_encoding re-encoding the
+// response as binary protobuf. It is not called "proto" like the backend
+// encoding, as lura falls back to the backend encoding to pick the render of
+// single backend endpoints without an output_encoding.
+const protobufRenderEncoding = "protobuf"
+
+// Media types served by the protobuf render, the first one being the default
+const (
+	mimeXProtobuf = "application/x-protobuf"
+	mimeProtobuf  = "application/protobuf"
+)
+
+// messageTypeParam is the Accept parameter selecting the message a response
+// is encoded to, e.g. "application/x-protobuf; messageType=acme.v1.Order"
+const messageTypeParam = "messageType"
+
+// renderTypes holds the message types a response can be encoded to: the
+// compiled-in default and every type loaded by a backend
+var renderTypes = struct {
+	sync.RWMutex
+	m map[string]protoreflect.MessageType
+}{m: map[string]protoreflect.MessageType{
+	string(defaultMessageType.Descriptor().FullName()): defaultMessageType,
+}}
+
+// registerRenderType makes a message type available to the protobuf render
+func registerRenderType(mt protoreflect.MessageType) {
+	renderTypes.Lock()
+	renderTypes.m[string(mt.Descriptor().FullName())] = mt
+	renderTypes.Unlock()
+}
+
+// findRenderType returns the message type named in an Accept parameter, or
+// the default one when no name is given
+func findRenderType(name string) (protoreflect.MessageType, bool) {
+	if name == "" {
+		return defaultMessageType, true
+	}
+	renderTypes.RLock()
+	mt, ok := renderTypes.m[name]
+	renderTypes.RUnlock()
+	return mt, ok
+}
+
+// protobufRender encodes the merged response with the message type asked for
+// in the Accept header, FeedMessage when none is named. Keys that are not
+// fields of the message, such as the ones added by the gateway, are dropped,
+// but a response without any field of the message, such as the one of a
+// backend serving another message, is answered with a 500 error rather than
+// an empty message.
+func protobufRender(c *gin.Context, response *proxy.Response) {
+	status := c.Writer.Status()
+	l := newLogger("[RENDER: " + protobufRenderEncoding + "]")
+
+	contentType, name := acceptedProtobuf(c.GetHeader("Accept"))
+	mt, ok := findRenderType(name)
+	if !ok {
+		l.Warning("Unknown message type requested:", name)
+		c.Status(http.StatusNotAcceptable)
+		return
+	}
+
+	message := mt.New().Interface()
+	if response != nil && len(response.Data) > 0 {
+		if !matchesMessage(response.Data, mt.Descriptor()) {
+			l.Error("The response is not a", mt.Descriptor().FullName(), "message, none of its keys is a field")
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(response.Data)
+		if err == nil {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true, AllowPartial: true}.Unmarshal(data, message)
+		}
+		if err != nil {
+			l.Error("Converting the response to", mt.Descriptor().FullName(), "-", err.Error())
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data, err := proto.MarshalOptions{AllowPartial: true}.Marshal(message)
+	if err != nil {
+		l.Error("Marshaling", mt.Descriptor().FullName(), "-", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(status, contentType, data)
+}
+
+// matchesMessage reports whether a decoded response holds at least one field
+// of a message, by JSON or proto name. Otherwise every key would be dropped,
+// encoding an empty message.
+func matchesMessage(data map[string]interface{}, md protoreflect.MessageDescriptor) bool {
+	fields := md.Fields()
+	for k := range data {
+		if fields.ByJSONName(k) != nil || fields.ByName(protoreflect.Name(k)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedProtobuf returns the protobuf media type listed in an Accept header,
+// mimeXProtobuf when there is none, and the message type it names if any
+func acceptedProtobuf(accept string) (string, string) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == mimeXProtobuf || mediaType == mimeProtobuf {
+			// Parameter names are case-insensitive, and lowercased when parsed
+			return mediaType, params[strings.ToLower(messageTypeParam)]
+		}
+	}
+	return mimeXProtobuf, ""
+}
+
+// negotiatedRender adds protobuf to the formats offered by the lura
+// "negotiate" render, which renders the other formats. JSON stays the default.
+func negotiatedRender(c *gin.Context, response *proxy.Response) {
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain, gin.MIMEXML, gin.MIMEYAML, mimeXProtobuf, mimeProtobuf) {
+	case mimeXProtobuf, mimeProtobuf:
+		protobufRender(c, response)
+	default:
+		luraNegotiatedRender(c, response)
+	}
+}
+
+// renderedResponseKey is the gin context key handing the response over to
+// the proxy of luraNegotiatedRender
+const renderedResponseKey = "krakend-pb-to-json-response"
+
+// luraNegotiatedRender is the lura "negotiate" render. Lura does not export
+// its renders, so it is reached through an endpoint handler using that
+// output encoding, whose proxy answers with the response being rendered.
+var luraNegotiatedRender = func() func(*gin.Context, *proxy.Response) {
+	handler := luragin.EndpointHandler(&config.EndpointConfig{
+		OutputEncoding: luragin.NEGOTIATE,
+		// The proxy answers at once, but a zero timeout would expire first
+		Timeout: time.Minute,
+	}, func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		response, _ := ctx.Value(renderedResponseKey).(*proxy.Response)
+		return response, nil
+	})
+
+	return func(c *gin.Context, response *proxy.Response) {
+		if response != nil {
+			// The headers are already set by the endpoint handler serving
+			// the request, and would be added twice
+			response = &proxy.Response{Data: response.Data, IsComplete: response.IsComplete, Io: response.Io}
+		}
+		c.Set(renderedResponseKey, response)
+		handler(c)
+	}
+}()
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// encodeRequest replaces the JSON body of a request by its protobuf encoding.
+// Bodies that are not valid JSON for the request message are rejected with a
+// 400, before anything is sent to the backend.
+func (d protoDecoder) encodeRequest(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return newDecodeError(http.StatusBadRequest, errCodeInvalidRequest, "Failed to read the request body", err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		req.Body = http.NoBody
+		return nil
+	}
+
+	message := d.reqType.New().Interface()
+	opts := protojson.UnmarshalOptions{
+		DiscardUnknown: d.cfg.Request.DiscardUnknown,
+		AllowPartial:   d.cfg.Marshal.AllowPartial,
+	}
+	if err := opts.Unmarshal(body, message); err != nil {
+		return newDecodeError(http.StatusBadRequest, errCodeInvalidRequest, "Failed to parse the request body", err)
+	}
+
+	data, err := proto.MarshalOptions{AllowPartial: d.cfg.Marshal.AllowPartial}.Marshal(message)
+	if err != nil {
+		return newDecodeError(http.StatusBadRequest, errCodeInvalidRequest, "Failed to encode the request body", err)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.ContentLength = int64(len(data))
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Del("Content-Length")
+	return nil
+}
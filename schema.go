@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// defaultMessageType is the compiled-in GTFS-realtime FeedMessage, used when
+// a backend does not configure a schema of its own
+var defaultMessageType = (&pbproto.FeedMessage{}).ProtoReflect().Type()
+
+// schemaConfig describes where the schema used to decode a backend comes from
+type schemaConfig struct {
+	// Full name of the message to decode, e.g. "transit_realtime.FeedMessage"
+	MessageType string
+	// Binary FileDescriptorSet to load the message from
+	DescriptorSet string
+	// Raw .proto sources to compile, relative to ImportPaths
+	ProtoFiles  []string
+	ImportPaths []string
+}
+
+// loadMessageType resolves the message type used to decode a backend payload.
+//
+// When no schema source is configured the message is looked up among the types
+// compiled into the plugin. Otherwise the descriptors are loaded from disk and
+// the message is decoded with dynamicpb, so no recompilation is needed.
+func loadMessageType(sc schemaConfig) (protoreflect.MessageType, error) {
+	if sc.DescriptorSet != "" && len(sc.ProtoFiles) > 0 {
+		return nil, errors.New("descriptor_set and proto_files are mutually exclusive")
+	}
+
+	if sc.DescriptorSet == "" && len(sc.ProtoFiles) == 0 {
+		if sc.MessageType == "" {
+			return defaultMessageType, nil
+		}
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(sc.MessageType))
+		if err != nil {
+			return nil, fmt.Errorf("message type %q not compiled into the plugin: %w", sc.MessageType, err)
+		}
+		return mt, nil
+	}
+
+	if sc.MessageType == "" {
+		return nil, errors.New("message_type is required when a schema source is set")
+	}
+
+	if sc.DescriptorSet != "" {
+		files, err := loadDescriptorSet(sc.DescriptorSet)
+		if err != nil {
+			return nil, err
+		}
+		return findMessageType(files, sc.MessageType)
+	}
+
+	files, err := compileProtoFiles(sc.ProtoFiles, sc.ImportPaths)
+	if err != nil {
+		return nil, err
+	}
+	return findMessageType(files, sc.MessageType)
+}
+
+// loadDescriptorSet reads a binary FileDescriptorSet (.pb/.binpb), as produced
+// by `protoc --include_imports --descriptor_set_out`, and builds a file registry
+func loadDescriptorSet(path string) (*protoregistry.Files, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading descriptor set: %w", err)
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, fds); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %w", path, err)
+	}
+
+	files, err := protodesc.NewFiles(fds)
+	if err != nil {
+		return nil, fmt.Errorf("building registry from %s: %w", path, err)
+	}
+	return files, nil
+}
+
+// compileProtoFiles parses and links raw .proto sources in-process, so no protoc
+// run is needed. Imports are resolved against importPaths (or the working
+// directory when empty), and the well-known google/protobuf files are built in.
+func compileProtoFiles(protoFiles, importPaths []string) (*protoregistry.Files, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: importPaths,
+		}),
+	}
+
+	compiled, err := compiler.Compile(context.Background(), protoFiles...)
+	if err != nil {
+		return nil, fmt.Errorf("compiling proto files: %w", err)
+	}
+
+	files := &protoregistry.Files{}
+	for _, fd := range compiled {
+		if err := registerFile(files, fd); err != nil {
+			return nil, fmt.Errorf("registering %s: %w", fd.Path(), err)
+		}
+	}
+	return files, nil
+}
+
+// registerFile adds a file and, first, all of its transitive imports
+func registerFile(files *protoregistry.Files, fd protoreflect.FileDescriptor) error {
+	if _, err := files.FindFileByPath(fd.Path()); err == nil {
+		return nil
+	}
+
+	imports := fd.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		if err := registerFile(files, imports.Get(i).FileDescriptor); err != nil {
+			return err
+		}
+	}
+	return files.RegisterFile(fd)
+}
+
+// findMessageType looks up a message by its full name (e.g.
+// "transit_realtime.FeedMessage") and returns a dynamic type for it
+func findMessageType(files *protoregistry.Files, messageType string) (protoreflect.MessageType, error) {
+	d, err := files.FindDescriptorByName(protoreflect.FullName(messageType))
+	if err != nil {
+		return nil, fmt.Errorf("message type %q: %w", messageType, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a message", messageType)
+	}
+	return dynamicpb.NewMessageType(md), nil
+}
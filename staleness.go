@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// Staleness actions, deciding what is done with the feeds and entities older
+// than the max age
+const (
+	stalenessAnnotate = "annotate"
+	stalenessDrop     = "drop"
+	stalenessFail     = "fail"
+)
+
+// stalenessKey is the JSON key the age of the feed is added under by the
+// annotate action
+const stalenessKey = "_staleness"
+
+// feedAgeHeader is the response header holding the age of the feed, in
+// seconds, when its header has a timestamp
+const feedAgeHeader = "X-Feed-Age"
+
+// stalenessReport describes the age of a feed
+type stalenessReport struct {
+	// Age of the feed header in seconds, nil when it has no timestamp
+	FeedAge *int64 `json:"feed_age"`
+	MaxAge  int64  `json:"max_age"`
+	Stale   bool   `json:"stale"`
+	// Number of entities older than the max age
+	StaleEntities int `json:"stale_entities"`
+}
+
+// maxAge returns the age past which a feed or an entity is stale, 0 when the
+// checks are disabled
+func (s StalenessConfig) maxAge() time.Duration {
+	d, _ := time.ParseDuration(s.MaxAge)
+	return d
+}
+
+// checkStaleness measures the age of a feed and of its entities
+func checkStaleness(feed *pbproto.FeedMessage, now time.Time, maxAge time.Duration) *stalenessReport {
+	r := &stalenessReport{MaxAge: int64(maxAge / time.Second)}
+	if ts := feed.GetHeader().GetTimestamp(); ts != 0 {
+		age := now.Unix() - int64(ts)
+		r.FeedAge = &age
+		r.Stale = isStale(ts, now, maxAge)
+	}
+	for _, e := range feed.GetEntity() {
+		if isStale(entityTimestamp(feed, e), now, maxAge) {
+			r.StaleEntities++
+		}
+	}
+	return r
+}
+
+// setHeader reports the age of the feed in a response header
+func (r *stalenessReport) setHeader(h http.Header) {
+	if r.FeedAge != nil {
+		h.Set(feedAgeHeader, strconv.FormatInt(*r.FeedAge, 10))
+	}
+}
+
+// dropStaleEntities removes the entities older than the max age from a feed
+// and returns how many were removed
+func dropStaleEntities(feed *pbproto.FeedMessage, now time.Time, maxAge time.Duration) int {
+	kept := feed.Entity[:0]
+	for _, e := range feed.GetEntity() {
+		if !isStale(entityTimestamp(feed, e), now, maxAge) {
+			kept = append(kept, e)
+		}
+	}
+	dropped := len(feed.Entity) - len(kept)
+	feed.Entity = kept
+	return dropped
+}
+
+// entityTimestamp returns the timestamp of the data of an entity: the one of
+// its trip update or vehicle position, or else the one of the feed
+func entityTimestamp(feed *pbproto.FeedMessage, e *pbproto.FeedEntity) uint64 {
+	switch {
+	case e.GetTripUpdate().GetTimestamp() != 0:
+		return e.GetTripUpdate().GetTimestamp()
+	case e.GetVehicle().GetTimestamp() != 0:
+		return e.GetVehicle().GetTimestamp()
+	}
+	return feed.GetHeader().GetTimestamp()
+}
+
+// isStale reports whether a timestamp is older than the max age. Data without
+// a timestamp cannot be told stale.
+func isStale(ts uint64, now time.Time, maxAge time.Duration) bool {
+	return ts != 0 && now.Sub(time.Unix(int64(ts), 0)) > maxAge
+}
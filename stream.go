@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// streamDelimited decodes a stream of varint length-delimited messages (the
+// protodelim format) one at a time, so the upstream payload and its decoded
+// messages are never held as a whole. The JSON output still is: lura records
+// the response of http-client plugins before handing it over, so the client
+// only gets it once the whole stream is decoded.
+//
+// The output is either a JSON array or newline-delimited JSON. Once the first
+// message has been written the status can no longer change, so a failure in
+// the middle of the stream is reported as a trailing {"_error": {...}} item.
+func (r registerer) streamDelimited(w http.ResponseWriter, req *http.Request, resp *http.Response, dec protoDecoder, l requestLogger) {
+	cfg := dec.cfg
+
+	br, _, err := openBody(resp, cfg)
+	if err != nil {
+		l.Error("Reading upstream payload:", err.Error())
+		writeError(w, req, err)
+		return
+	}
+
+	opts := protodelim.UnmarshalOptions{MaxSize: -1}
+	opts.UnmarshalOptions.AllowPartial = cfg.Marshal.AllowPartial
+	if cfg.MaxBodySize > 0 {
+		opts.MaxSize = cfg.MaxBodySize
+	}
+
+	// Every item of an NDJSON stream must fit in a single line
+	mc := cfg.Marshal
+	if cfg.StreamOutput == streamOutputNDJSON {
+		mc.Multiline = false
+		mc.Indent = ""
+	}
+
+	sw := &streamWriter{w: w, ndjson: cfg.StreamOutput == streamOutputNDJSON}
+	if cfg.Collection.enabled() {
+		sw.wrapKey = dec.collectionKey()
+	}
+	count := 0
+
+	for {
+		message := dec.msgType.New().Interface()
+		err := opts.UnmarshalFrom(br, message)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var item []byte
+		if err == nil {
+			item, err = dec.toJSON(message, mc)
+		}
+		if err != nil {
+			de := streamError(err, count)
+			l.Error(fmt.Sprintf("Decoding message #%d of the stream:", count), err.Error())
+			if !sw.started {
+				// Nothing written yet, so a proper error status is still possible
+				writeError(w, req, de)
+				return
+			}
+			de.Backend = req.URL.Host + req.URL.Path
+			sw.writeError(de)
+			break
+		}
+
+		if !sw.started {
+			copyHeaders(w.Header(), resp.Header)
+			w.Header().Set("Content-Type", sw.contentType())
+			w.WriteHeader(resp.StatusCode)
+		}
+		sw.writeItem(item)
+		count++
+	}
+
+	if !sw.started {
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Set("Content-Type", sw.contentType())
+		w.WriteHeader(resp.StatusCode)
+	}
+	sw.close()
+	l.Debug(fmt.Sprintf("Streamed %d %s messages", count, dec.msgType.Descriptor().FullName()))
+}
+
+// streamError maps a failure while reading the stream to the error contract
+func streamError(err error, index int) *decodeError {
+	var tooLarge *protodelim.SizeTooLargeError
+	if errors.As(err, &tooLarge) {
+		return newDecodeError(http.StatusRequestEntityTooLarge, errCodeTooLarge,
+			fmt.Sprintf("Message #%d exceeds max_body_size", index), err)
+	}
+	return newDecodeError(http.StatusBadGateway, errCodeInvalidPayload,
+		fmt.Sprintf("Failed to parse message #%d of the stream", index), err)
+}
+
+// streamWriter frames the decoded messages as a JSON array or as NDJSON. With
+// a wrapKey the array is wrapped in an object, as a lura collection.
+type streamWriter struct {
+	w       io.Writer
+	ndjson  bool
+	wrapKey string
+	started bool
+}
+
+func (s *streamWriter) contentType() string {
+	if s.ndjson {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+func (s *streamWriter) writeItem(item []byte) {
+	switch {
+	case s.ndjson:
+	case !s.started:
+		s.open()
+	default:
+		io.WriteString(s.w, ",")
+	}
+	s.started = true
+	s.w.Write(item)
+	if s.ndjson {
+		io.WriteString(s.w, "\n")
+	}
+}
+
+func (s *streamWriter) writeError(de *decodeError) {
+	body, _ := json.Marshal(map[string]interface{}{"_error": de})
+	s.writeItem(body)
+}
+
+func (s *streamWriter) open() {
+	if s.wrapKey != "" {
+		key, _ := json.Marshal(s.wrapKey)
+		fmt.Fprintf(s.w, "{%s:", key)
+	}
+	io.WriteString(s.w, "[")
+}
+
+// close terminates the array, which is empty if nothing was written
+func (s *streamWriter) close() {
+	if s.ndjson {
+		return
+	}
+	if !s.started {
+		s.open()
+	}
+	io.WriteString(s.w, "]")
+	if s.wrapKey != "" {
+		io.WriteString(s.w, "}")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// Formats of the stop_times transform
+const (
+	tableFormatCSV    = "csv"
+	tableFormatNDJSON = "ndjson"
+)
+
+// stopTimeRow is a stop time update along with the trip update holding it
+type stopTimeRow struct {
+	entity *pbproto.FeedEntity
+	trip   *pbproto.TripUpdate
+	stu    *pbproto.TripUpdate_StopTimeUpdate
+}
+
+// stopTimeColumn extracts a cell of a row, reporting whether it is set
+type stopTimeColumn func(r stopTimeRow, enumNumbers bool) (interface{}, bool)
+
+// stopTimeColumns lists the columns the stop_times transform can output
+var stopTimeColumns = map[string]stopTimeColumn{
+	"entity_id": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		return r.entity.GetId(), r.entity.Id != nil
+	},
+	"trip_id": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		t := r.trip.GetTrip()
+		return t.GetTripId(), t != nil && t.TripId != nil
+	},
+	"route_id": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		t := r.trip.GetTrip()
+		return t.GetRouteId(), t != nil && t.RouteId != nil
+	},
+	"direction_id": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		t := r.trip.GetTrip()
+		return t.GetDirectionId(), t != nil && t.DirectionId != nil
+	},
+	"start_date": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		t := r.trip.GetTrip()
+		return t.GetStartDate(), t != nil && t.StartDate != nil
+	},
+	"start_time": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		t := r.trip.GetTrip()
+		return t.GetStartTime(), t != nil && t.StartTime != nil
+	},
+	"vehicle_id": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		v := r.trip.GetVehicle()
+		return v.GetId(), v != nil && v.Id != nil
+	},
+	"stop_id": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		return r.stu.GetStopId(), r.stu.StopId != nil
+	},
+	"stop_sequence": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		return r.stu.GetStopSequence(), r.stu.StopSequence != nil
+	},
+	"arrival_delay": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		e := r.stu.GetArrival()
+		return e.GetDelay(), e != nil && e.Delay != nil
+	},
+	"arrival_time": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		e := r.stu.GetArrival()
+		return e.GetTime(), e != nil && e.Time != nil
+	},
+	"arrival_uncertainty": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		e := r.stu.GetArrival()
+		return e.GetUncertainty(), e != nil && e.Uncertainty != nil
+	},
+	"departure_delay": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		e := r.stu.GetDeparture()
+		return e.GetDelay(), e != nil && e.Delay != nil
+	},
+	"departure_time": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		e := r.stu.GetDeparture()
+		return e.GetTime(), e != nil && e.Time != nil
+	},
+	"departure_uncertainty": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		e := r.stu.GetDeparture()
+		return e.GetUncertainty(), e != nil && e.Uncertainty != nil
+	},
+	"schedule_relationship": func(r stopTimeRow, enumNumbers bool) (interface{}, bool) {
+		return enumValue(r.stu.GetScheduleRelationship(), enumNumbers), r.stu.ScheduleRelationship != nil
+	},
+	"trip_schedule_relationship": func(r stopTimeRow, enumNumbers bool) (interface{}, bool) {
+		t := r.trip.GetTrip()
+		return enumValue(t.GetScheduleRelationship(), enumNumbers), t != nil && t.ScheduleRelationship != nil
+	},
+	"timestamp": func(r stopTimeRow, _ bool) (interface{}, bool) {
+		return r.trip.GetTimestamp(), r.trip.Timestamp != nil
+	},
+}
+
+// defaultStopTimeColumns are the columns output when none are configured
+var defaultStopTimeColumns = []string{
+	"entity_id", "trip_id", "route_id", "stop_id", "stop_sequence",
+	"arrival_delay", "arrival_time", "departure_delay", "departure_time",
+	"schedule_relationship",
+}
+
+// checkStopTimeColumns reports the configured columns that do not exist
+func checkStopTimeColumns(columns []string) []string {
+	var problems []string
+	for _, c := range columns {
+		if _, ok := stopTimeColumns[c]; !ok {
+			problems = append(problems, fmt.Sprintf("table.columns: unknown column %q, expected one of %v", c, stopTimeColumnNames()))
+		}
+	}
+	return problems
+}
+
+// stopTimeColumnNames lists the known columns, sorted
+func stopTimeColumnNames() []string {
+	names := make([]string, 0, len(stopTimeColumns))
+	for name := range stopTimeColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stopTimes flattens the trip updates of a feed into one row per stop time
+// update, rendered as CSV with a header line or as NDJSON. Unset cells are
+// left empty in CSV and null in NDJSON.
+func stopTimes(feed *pbproto.FeedMessage, tc TableConfig, enumNumbers bool) ([]byte, error) {
+	columns := tc.columns()
+
+	var buf bytes.Buffer
+	var w *csv.Writer
+	if tc.Format == tableFormatCSV {
+		w = csv.NewWriter(&buf)
+		if err := w.Write(columns); err != nil {
+			return nil, err
+		}
+	}
+
+	record := make([]string, len(columns))
+	for _, entity := range feed.GetEntity() {
+		tu := entity.GetTripUpdate()
+		if entity.GetIsDeleted() || tu == nil {
+			continue
+		}
+		for _, stu := range tu.GetStopTimeUpdate() {
+			row := stopTimeRow{entity: entity, trip: tu, stu: stu}
+
+			if w != nil {
+				for i, c := range columns {
+					record[i] = ""
+					if v, ok := stopTimeColumns[c](row, enumNumbers); ok {
+						record[i] = fmt.Sprint(v)
+					}
+				}
+				if err := w.Write(record); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			// Written by hand to keep the columns in the configured order
+			buf.WriteByte('{')
+			for i, c := range columns {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				key, _ := json.Marshal(c)
+				buf.Write(key)
+				buf.WriteByte(':')
+				v, ok := stopTimeColumns[c](row, enumNumbers)
+				if !ok {
+					v = nil
+				}
+				value, err := json.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+				buf.Write(value)
+			}
+			buf.WriteString("}\n")
+		}
+	}
+
+	if w != nil {
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// contentType returns the media type of the stop_times output
+func (tc TableConfig) contentType() string {
+	if tc.Format == tableFormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// columns returns the configured columns, or the default ones
+func (tc TableConfig) columns() []string {
+	if len(tc.Columns) == 0 {
+		return defaultStopTimeColumns
+	}
+	return tc.Columns
+}
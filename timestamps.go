@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// Embedded so timestamps.timezone works on hosts without a zoneinfo
+	// database, such as minimal containers
+	_ "time/tzdata"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Suffixes of the keys the timestamps are formatted under, for each naming
+// style of the JSON output
+const (
+	isoSuffixProto = "_iso"
+	isoSuffixJSON  = "Iso"
+)
+
+// timestampFields formats the POSIX timestamps found at a set of field paths
+// as RFC 3339 strings
+type timestampFields struct {
+	// Rendered keys leading to every timestamp field
+	paths [][]string
+	loc   *time.Location
+	// Replace the raw values instead of adding a companion key
+	replace bool
+	suffix  string
+}
+
+// newTimestampFields checks every path against the message descriptor. A
+// path must go through message fields, repeated or not, and end with an
+// integer field holding seconds since the epoch.
+func newTimestampFields(md protoreflect.MessageDescriptor, tc TimestampConfig, useProtoNames bool) (timestampFields, error) {
+	loc, err := time.LoadLocation(tc.Timezone)
+	if err != nil {
+		return timestampFields{}, err
+	}
+	tf := timestampFields{loc: loc, replace: tc.Replace, suffix: isoSuffixJSON}
+	if useProtoNames {
+		tf.suffix = isoSuffixProto
+	}
+
+	for _, path := range tc.Fields {
+		var keys []string
+		current := md
+		var last protoreflect.FieldDescriptor
+		for _, name := range strings.Split(path, ".") {
+			if current == nil {
+				return timestampFields{}, fmt.Errorf("%q: %s is not a message", path, last.Name())
+			}
+			fd := current.Fields().ByName(protoreflect.Name(name))
+			if fd == nil {
+				return timestampFields{}, fmt.Errorf("%q: unknown field %s in %s", path, name, current.FullName())
+			}
+			if fd.IsMap() {
+				return timestampFields{}, fmt.Errorf("%q: cannot go inside map field %s", path, name)
+			}
+
+			key := fd.JSONName()
+			if useProtoNames {
+				key = string(fd.Name())
+			}
+			keys = append(keys, key)
+			current, last = fd.Message(), fd
+		}
+
+		switch last.Kind() {
+		case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Uint32Kind, protoreflect.Uint64Kind,
+			protoreflect.Sint32Kind, protoreflect.Sint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind,
+			protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		default:
+			return timestampFields{}, fmt.Errorf("%q: %s is not an integer field", path, last.Name())
+		}
+		if last.IsList() {
+			return timestampFields{}, fmt.Errorf("%q: %s is a repeated field", path, last.Name())
+		}
+		tf.paths = append(tf.paths, keys)
+	}
+	return tf, nil
+}
+
+// apply formats the timestamps of a decoded JSON value, descending into
+// repeated fields
+func (tf timestampFields) apply(v interface{}) {
+	for _, keys := range tf.paths {
+		tf.applyPath(v, keys)
+	}
+}
+
+func (tf timestampFields) applyPath(v interface{}, keys []string) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			tf.applyPath(item, keys)
+		}
+	case map[string]interface{}:
+		value, ok := t[keys[0]]
+		if !ok {
+			return
+		}
+		if len(keys) > 1 {
+			tf.applyPath(value, keys[1:])
+			return
+		}
+		if tf.replace {
+			t[keys[0]] = tf.format(value)
+		} else {
+			t[keys[0]+tf.suffix] = tf.format(value)
+		}
+	}
+}
+
+// format renders a decoded timestamp, a string for 64-bit fields and a number
+// otherwise, in the configured timezone. Unset and zero timestamps are
+// rendered as null.
+func (tf timestampFields) format(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	secs, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+	if err != nil || secs == 0 {
+		return nil
+	}
+	return time.Unix(secs, 0).In(tf.loc).Format(time.RFC3339)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// validationKey is the JSON key the findings of the annotate mode are added
+// under
+const validationKey = "_validation"
+
+// Validation modes, deciding what is done with the findings on a feed
+const (
+	validationModeOff      = "off"
+	validationModeAnnotate = "annotate"
+	validationModeReport   = "report"
+)
+
+// Severities of the validation rules
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Bounds of the timestamps accepted as POSIX time, in seconds: values out of
+// them are likely to be in milliseconds, or garbage
+const (
+	minPOSIXTime = 1000000000 // 2001-09-09
+	maxPOSIXTime = 4102444800 // 2100-01-01
+)
+
+// defaultMaxFindings is the number of findings listed by default
+const defaultMaxFindings = 100
+
+// maxClockSkew is how far in the future a timestamp may be before it is
+// reported
+const maxClockSkew = time.Minute
+
+// validationRule is a check run on every feed. The codes follow the ones of
+// the MobilityData GTFS-realtime validator for the rules it has, and start
+// with PB for the ones it does not.
+type validationRule struct {
+	Severity string
+	Title    string
+}
+
+// validationRules are the rules checked by validateFeed, by code. The rules
+// of the MobilityData validator comparing the feed with the static GTFS, or
+// with the previous feeds, are not implemented.
+var validationRules = map[string]validationRule{
+	"E001":  {severityError, "Timestamp not in POSIX time"},
+	"E002":  {severityError, "stop_time_updates not sorted by stop_sequence"},
+	"E012":  {severityError, "Header timestamp older than an entity timestamp"},
+	"E020":  {severityError, "Invalid start_time format"},
+	"E021":  {severityError, "Invalid start_date format"},
+	"E022":  {severityError, "Sequential stop_time_update times decreasing"},
+	"E025":  {severityError, "Departure before arrival"},
+	"E026":  {severityError, "Invalid vehicle position"},
+	"E027":  {severityError, "Invalid vehicle bearing"},
+	"E032":  {severityError, "Alert without informed_entity"},
+	"E033":  {severityError, "informed_entity without any specifier"},
+	"E036":  {severityError, "Sequential stop_time_updates with the same stop_sequence"},
+	"E037":  {severityError, "Sequential stop_time_updates with the same stop_id"},
+	"E038":  {severityError, "Invalid gtfs_realtime_version"},
+	"E039":  {severityError, "is_deleted set in a FULL_DATASET feed"},
+	"E040":  {severityError, "stop_time_update without stop_id nor stop_sequence"},
+	"E041":  {severityError, "trip_update without stop_time_updates"},
+	"E042":  {severityError, "Arrival or departure set for a NO_DATA stop_time_update"},
+	"E043":  {severityError, "stop_time_update without arrival nor departure"},
+	"E044":  {severityError, "Arrival or departure without delay nor time"},
+	"E048":  {severityError, "Header timestamp not set"},
+	"E049":  {severityError, "Header incrementality not set"},
+	"E050":  {severityError, "Timestamp in the future"},
+	"W001":  {severityWarning, "Entity timestamp not set"},
+	"W002":  {severityWarning, "trip_update without vehicle id"},
+	"W006":  {severityWarning, "trip_update without trip_id"},
+	"PB001": {severityError, "Empty entity id"},
+	"PB002": {severityError, "Duplicate entity id"},
+	"PB003": {severityWarning, "Vehicle position at 0,0"},
+	"PB004": {severityError, "Negative uncertainty"},
+}
+
+var (
+	startTimePattern = regexp.MustCompile(`^[0-9]{2}:[0-5][0-9]:[0-5][0-9]$`)
+	versionPattern   = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+)
+
+// validationFinding is a rule broken by a feed
+type validationFinding struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	// Id of the entity at fault, empty for the header
+	EntityID string `json:"entity_id,omitempty"`
+	// Path of the faulty field, with the proto field names, e.g.
+	// "entity[3].trip_update.stop_time_update[2].arrival"
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// validationReport lists the rules broken by a feed. Counts cover every
+// finding, while Findings stops at the configured maximum.
+type validationReport struct {
+	Errors    int                 `json:"errors"`
+	Warnings  int                 `json:"warnings"`
+	Counts    map[string]int      `json:"counts"`
+	Findings  []validationFinding `json:"findings"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+// feedValidator runs the rules over a feed
+type feedValidator struct {
+	now    time.Time
+	cfg    ValidationConfig
+	report *validationReport
+	// Header timestamp, 0 when not set
+	headerTime uint64
+	// Stop sequences of every stop of the trip updates, by trip_id and stop_id
+	tripStops map[string]map[string][]uint32
+}
+
+// checkValidationRules reports the codes that are not validation rules
+func checkValidationRules(codes []string) []string {
+	var problems []string
+	for _, code := range codes {
+		if _, ok := validationRules[code]; !ok {
+			problems = append(problems, fmt.Sprintf("validation.ignore: unknown rule %q", code))
+		}
+	}
+	return problems
+}
+
+// validateFeed checks a feed against the rules that are not ignored
+func validateFeed(feed *pbproto.FeedMessage, now time.Time, cfg ValidationConfig) *validationReport {
+	v := feedValidator{
+		now:        now,
+		cfg:        cfg,
+		report:     &validationReport{Counts: map[string]int{}, Findings: []validationFinding{}},
+		headerTime: feed.GetHeader().GetTimestamp(),
+		tripStops:  tripStopSequences(feed),
+	}
+
+	header := feed.GetHeader()
+	version := header.GetGtfsRealtimeVersion()
+	if !versionPattern.MatchString(version) {
+		v.add("E038", "", "header.gtfs_realtime_version", "%q is not a version", version)
+	}
+	if compareVersions(version, "2.0") >= 0 {
+		if header.Timestamp == nil {
+			v.add("E048", "", "header.timestamp", "required since version 2.0")
+		}
+		if header.Incrementality == nil {
+			v.add("E049", "", "header.incrementality", "required since version 2.0")
+		}
+	}
+	if header.Timestamp != nil {
+		v.checkTimestamp("", "header.timestamp", header.GetTimestamp())
+	}
+
+	full := header.GetIncrementality() == pbproto.FeedHeader_FULL_DATASET
+	seen := map[string]bool{}
+	for i, e := range feed.GetEntity() {
+		path := fmt.Sprintf("entity[%d]", i)
+		id := e.GetId()
+		switch {
+		case id == "":
+			v.add("PB001", "", path+".id", "entities must have an id")
+		case seen[id]:
+			v.add("PB002", id, path+".id", "%q is used by another entity", id)
+		}
+		seen[id] = true
+
+		if full && e.GetIsDeleted() {
+			v.add("E039", id, path+".is_deleted", "deletions are only meaningful in DIFFERENTIAL feeds")
+		}
+		if e.TripUpdate != nil {
+			v.checkTripUpdate(id, path+".trip_update", e.GetTripUpdate())
+		}
+		if e.Vehicle != nil {
+			v.checkVehicle(id, path+".vehicle", e.GetVehicle())
+		}
+		if e.Alert != nil {
+			v.checkAlert(id, path+".alert", e.GetAlert())
+		}
+	}
+	return v.report
+}
+
+// add records a finding, unless its rule is ignored
+func (v *feedValidator) add(code, entityID, path, format string, args ...interface{}) {
+	for _, ignored := range v.cfg.Ignore {
+		if ignored == code {
+			return
+		}
+	}
+
+	rule := validationRules[code]
+	r := v.report
+	r.Counts[code]++
+	if rule.Severity == severityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+	if len(r.Findings) >= v.cfg.MaxFindings {
+		r.Truncated = true
+		return
+	}
+	r.Findings = append(r.Findings, validationFinding{
+		Code:     code,
+		Severity: rule.Severity,
+		Title:    rule.Title,
+		EntityID: entityID,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkTimestamp checks a timestamp is in seconds and not in the future
+func (v *feedValidator) checkTimestamp(id, path string, ts uint64) {
+	if ts < minPOSIXTime || ts > maxPOSIXTime {
+		v.add("E001", id, path, "%d is not a number of seconds since 1970", ts)
+		return
+	}
+	if at := time.Unix(int64(ts), 0); at.After(v.now.Add(maxClockSkew)) {
+		v.add("E050", id, path, "%d is %s in the future", ts, at.Sub(v.now).Round(time.Second))
+	}
+}
+
+// checkEntityTimestamp checks the timestamp of a trip update or a vehicle
+// position, which the header one must not be older than
+func (v *feedValidator) checkEntityTimestamp(id, path string, ts *uint64) {
+	if ts == nil {
+		v.add("W001", id, path, "the age of the data cannot be told")
+		return
+	}
+	v.checkTimestamp(id, path, *ts)
+	if v.headerTime != 0 && *ts > v.headerTime {
+		v.add("E012", id, path, "%d is after the header timestamp %d", *ts, v.headerTime)
+	}
+}
+
+// checkTrip checks the formats of the start of a trip
+func (v *feedValidator) checkTrip(id, path string, t *pbproto.TripDescriptor) {
+	if t.StartTime != nil && !startTimePattern.MatchString(t.GetStartTime()) {
+		v.add("E020", id, path+".start_time", "%q is not HH:MM:SS", t.GetStartTime())
+	}
+	if t.StartDate != nil {
+		if _, err := time.Parse("20060102", t.GetStartDate()); err != nil {
+			v.add("E021", id, path+".start_date", "%q is not a YYYYMMDD date", t.GetStartDate())
+		}
+	}
+}
+
+func (v *feedValidator) checkTripUpdate(id, path string, tu *pbproto.TripUpdate) {
+	trip := tu.GetTrip()
+	if trip.GetTripId() == "" {
+		v.add("W006", id, path+".trip.trip_id", "the trip cannot be matched with the static GTFS")
+	}
+	if trip != nil {
+		v.checkTrip(id, path+".trip", trip)
+	}
+	if tu.GetVehicle().GetId() == "" {
+		v.add("W002", id, path+".vehicle.id", "the trip cannot be matched with a vehicle position")
+	}
+	v.checkEntityTimestamp(id, path+".timestamp", tu.Timestamp)
+
+	switch trip.GetScheduleRelationship() {
+	case pbproto.TripDescriptor_CANCELED, pbproto.TripDescriptor_DELETED:
+	default:
+		if len(tu.GetStopTimeUpdate()) == 0 {
+			v.add("E041", id, path+".stop_time_update", "only canceled and deleted trips may have none")
+		}
+	}
+
+	var prev *pbproto.TripUpdate_StopTimeUpdate
+	var prevTime int64
+	for i, stu := range tu.GetStopTimeUpdate() {
+		p := fmt.Sprintf("%s.stop_time_update[%d]", path, i)
+		if stu.StopSequence == nil && stu.StopId == nil {
+			v.add("E040", id, p, "the stop cannot be told")
+		}
+		if prev != nil {
+			switch {
+			case stu.StopSequence == nil || prev.StopSequence == nil:
+			case stu.GetStopSequence() == prev.GetStopSequence():
+				v.add("E036", id, p+".stop_sequence", "%d follows itself", stu.GetStopSequence())
+			case stu.GetStopSequence() < prev.GetStopSequence():
+				v.add("E002", id, p+".stop_sequence", "%d follows %d", stu.GetStopSequence(), prev.GetStopSequence())
+			}
+			if stu.StopId != nil && stu.GetStopId() == prev.GetStopId() {
+				v.add("E037", id, p+".stop_id", "%q follows itself", stu.GetStopId())
+			}
+		}
+		prev = stu
+
+		arrival, departure := stu.GetArrival(), stu.GetDeparture()
+		switch stu.GetScheduleRelationship() {
+		case pbproto.TripUpdate_StopTimeUpdate_NO_DATA:
+			if arrival != nil || departure != nil {
+				v.add("E042", id, p, "NO_DATA stops have no predictions")
+			}
+			continue
+		case pbproto.TripUpdate_StopTimeUpdate_SKIPPED:
+			continue
+		}
+		if arrival == nil && departure == nil {
+			v.add("E043", id, p, "only SKIPPED and NO_DATA stops may have neither")
+		}
+		if arrival.GetTime() != 0 && departure.GetTime() != 0 && departure.GetTime() < arrival.GetTime() {
+			v.add("E025", id, p+".departure.time", "%d is before the arrival at %d", departure.GetTime(), arrival.GetTime())
+		}
+
+		// Latest time of the stop, for the checks of the next one
+		var stopTime int64
+		for _, ev := range []struct {
+			name  string
+			event *pbproto.TripUpdate_StopTimeEvent
+		}{{"arrival", arrival}, {"departure", departure}} {
+			if ev.event == nil {
+				continue
+			}
+			ep := p + "." + ev.name
+			if ev.event.Delay == nil && ev.event.Time == nil {
+				v.add("E044", id, ep, "the time cannot be told")
+			}
+			if ev.event.GetUncertainty() < 0 {
+				v.add("PB004", id, ep+".uncertainty", "%d is negative", ev.event.GetUncertainty())
+			}
+			if ev.event.Time == nil {
+				continue
+			}
+			t := ev.event.GetTime()
+			if t < minPOSIXTime || t > maxPOSIXTime {
+				v.add("E001", id, ep+".time", "%d is not a number of seconds since 1970", t)
+			}
+			if prevTime != 0 && t < prevTime {
+				v.add("E022", id, ep+".time", "%d is before the time of the previous stop %d", t, prevTime)
+			}
+			stopTime = t
+		}
+		if stopTime != 0 {
+			prevTime = stopTime
+		}
+	}
+}
+
+func (v *feedValidator) checkVehicle(id, path string, vp *pbproto.VehiclePosition) {
+	if vp.Trip != nil {
+		v.checkTrip(id, path+".trip", vp.GetTrip())
+	}
+	v.checkEntityTimestamp(id, path+".timestamp", vp.Timestamp)
+
+	// The stop the vehicle is at must be at the same place in the sequence
+	// as in the trip update of its trip
+	if vp.StopId != nil && vp.CurrentStopSequence != nil {
+		seqs, ok := v.tripStops[vp.GetTrip().GetTripId()][vp.GetStopId()]
+		if ok && !containsSequence(seqs, vp.GetCurrentStopSequence()) {
+			v.add("E002", id, path+".current_stop_sequence", "%d is out of sequence, the trip update has stop %q at %v",
+				vp.GetCurrentStopSequence(), vp.GetStopId(), seqs)
+		}
+	}
+
+	pos := vp.GetPosition()
+	if pos == nil {
+		return
+	}
+	lat, lon := pos.GetLatitude(), pos.GetLongitude()
+	switch {
+	case checkLatLon(float64(lat), float64(lon)) != nil:
+		v.add("E026", id, path+".position", "%g,%g is not on Earth", lat, lon)
+	case lat == 0 && lon == 0:
+		v.add("PB003", id, path+".position", "most likely an unknown position")
+	}
+	if pos.Bearing != nil {
+		if b := pos.GetBearing(); !(b >= 0 && b < 360) {
+			v.add("E027", id, path+".position.bearing", "%g is not in [0, 360)", b)
+		}
+	}
+}
+
+func (v *feedValidator) checkAlert(id, path string, a *pbproto.Alert) {
+	for i, tr := range a.GetActivePeriod() {
+		p := fmt.Sprintf("%s.active_period[%d]", path, i)
+		if tr.Start != nil && (tr.GetStart() < minPOSIXTime || tr.GetStart() > maxPOSIXTime) {
+			v.add("E001", id, p+".start", "%d is not a number of seconds since 1970", tr.GetStart())
+		}
+		if tr.End != nil && (tr.GetEnd() < minPOSIXTime || tr.GetEnd() > maxPOSIXTime) {
+			v.add("E001", id, p+".end", "%d is not a number of seconds since 1970", tr.GetEnd())
+		}
+	}
+
+	if len(a.GetInformedEntity()) == 0 {
+		v.add("E032", id, path+".informed_entity", "the alert applies to nothing")
+	}
+	for i, s := range a.GetInformedEntity() {
+		p := fmt.Sprintf("%s.informed_entity[%d]", path, i)
+		if s.AgencyId == nil && s.RouteId == nil && s.RouteType == nil && s.Trip == nil && s.StopId == nil {
+			v.add("E033", id, p, "one of agency_id, route_id, route_type, trip or stop_id is required")
+		}
+		if s.Trip != nil {
+			v.checkTrip(id, p+".trip", s.GetTrip())
+		}
+	}
+}
+
+// tripStopSequences indexes the stop sequences of the stop_time_updates of
+// every trip update with a trip_id, by stop_id. A stop may be visited more
+// than once by the same trip.
+func tripStopSequences(feed *pbproto.FeedMessage) map[string]map[string][]uint32 {
+	trips := map[string]map[string][]uint32{}
+	for _, e := range feed.GetEntity() {
+		tripID := e.GetTripUpdate().GetTrip().GetTripId()
+		if tripID == "" {
+			continue
+		}
+		stops := trips[tripID]
+		if stops == nil {
+			stops = map[string][]uint32{}
+			trips[tripID] = stops
+		}
+		for _, stu := range e.GetTripUpdate().GetStopTimeUpdate() {
+			if stu.StopId != nil && stu.StopSequence != nil {
+				stops[stu.GetStopId()] = append(stops[stu.GetStopId()], stu.GetStopSequence())
+			}
+		}
+	}
+	return trips
+}
+
+func containsSequence(seqs []uint32, seq uint32) bool {
+	for _, s := range seqs {
+		if s == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// codes lists the codes of the findings, for the logs
+func (r *validationReport) codes() []string {
+	codes := make([]string, 0, len(r.Counts))
+	for code := range r.Counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// render returns the report alone, for the report mode
+func (r *validationReport) render(mc MarshalConfig) ([]byte, error) {
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return mc.reformat(jsonData)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pbproto "github.com/fraserclark/krakend-pb-to-json/pkg/proto"
+)
+
+// validationNow is the time the test feeds are validated at
+const validationNow = 1700000000
+
+// validFeed builds a feed breaking no rule: a trip update, the position of
+// its vehicle and an alert
+func validFeed() *pbproto.FeedMessage {
+	now := uint64(validationNow)
+	return &pbproto.FeedMessage{
+		Header: &pbproto.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      pbproto.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(now),
+		},
+		Entity: []*pbproto.FeedEntity{
+			{
+				Id: proto.String("tu"),
+				TripUpdate: &pbproto.TripUpdate{
+					Trip: &pbproto.TripDescriptor{
+						TripId:    proto.String("t1"),
+						StartTime: proto.String("08:00:00"),
+						StartDate: proto.String("20231114"),
+					},
+					Vehicle:   &pbproto.VehicleDescriptor{Id: proto.String("v1")},
+					Timestamp: proto.Uint64(now - 10),
+					StopTimeUpdate: []*pbproto.TripUpdate_StopTimeUpdate{
+						{
+							StopSequence: proto.Uint32(1),
+							StopId:       proto.String("s1"),
+							Arrival:      &pbproto.TripUpdate_StopTimeEvent{Time: proto.Int64(validationNow + 60)},
+							Departure:    &pbproto.TripUpdate_StopTimeEvent{Time: proto.Int64(validationNow + 90)},
+						},
+						{
+							StopSequence: proto.Uint32(2),
+							StopId:       proto.String("s2"),
+							Arrival:      &pbproto.TripUpdate_StopTimeEvent{Time: proto.Int64(validationNow + 200)},
+							Departure:    &pbproto.TripUpdate_StopTimeEvent{Delay: proto.Int32(0)},
+						},
+					},
+				},
+			},
+			{
+				Id: proto.String("vp"),
+				Vehicle: &pbproto.VehiclePosition{
+					Trip:      &pbproto.TripDescriptor{TripId: proto.String("t1")},
+					Timestamp: proto.Uint64(now - 5),
+					Position: &pbproto.Position{
+						Latitude:  proto.Float32(41.4),
+						Longitude: proto.Float32(2.1),
+						Bearing:   proto.Float32(90),
+					},
+					StopId:              proto.String("s1"),
+					CurrentStopSequence: proto.Uint32(1),
+				},
+			},
+			{
+				Id: proto.String("al"),
+				Alert: &pbproto.Alert{
+					ActivePeriod: []*pbproto.TimeRange{{
+						Start: proto.Uint64(now - 100),
+						End:   proto.Uint64(now + 100),
+					}},
+					InformedEntity: []*pbproto.EntitySelector{{RouteId: proto.String("r1")}},
+				},
+			},
+		},
+	}
+}
+
+// Parts of validFeed changed by the test cases
+func tripUpdate(f *pbproto.FeedMessage) *pbproto.TripUpdate   { return f.Entity[0].TripUpdate }
+func vehicle(f *pbproto.FeedMessage) *pbproto.VehiclePosition { return f.Entity[1].Vehicle }
+func alert(f *pbproto.FeedMessage) *pbproto.Alert             { return f.Entity[2].Alert }
+func stopTimeUpdate(f *pbproto.FeedMessage, i int) *pbproto.TripUpdate_StopTimeUpdate {
+	return f.Entity[0].TripUpdate.StopTimeUpdate[i]
+}
+
+func TestValidateFeedValid(t *testing.T) {
+	r := validateFeed(validFeed(), time.Unix(validationNow, 0), ValidationConfig{MaxFindings: defaultMaxFindings})
+	if r.Errors != 0 || r.Warnings != 0 || len(r.Findings) != 0 {
+		t.Errorf("got findings on a valid feed: %+v", r.Findings)
+	}
+}
+
+// TestValidateFeedRules breaks every rule, then changes the feed in a way
+// close to breaking it that does not
+func TestValidateFeedRules(t *testing.T) {
+	breaking, passing := map[string]bool{}, map[string]bool{}
+	for _, tc := range []struct {
+		code string
+		name string
+		// Change made to validFeed
+		change func(f *pbproto.FeedMessage)
+		broken bool
+	}{
+		{"E001", "header timestamp in milliseconds", func(f *pbproto.FeedMessage) {
+			f.Header.Timestamp = proto.Uint64(validationNow * 1000)
+		}, true},
+		{"E001", "active period ending at the latest time accepted", func(f *pbproto.FeedMessage) {
+			alert(f).ActivePeriod[0].End = proto.Uint64(maxPOSIXTime)
+		}, false},
+
+		{"E002", "stop_sequence decreasing", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopSequence = proto.Uint32(0)
+		}, true},
+		{"E002", "stop_sequence skipping some stops", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopSequence = proto.Uint32(5)
+		}, false},
+		{"E002", "vehicle at a stop_sequence its trip update gives another stop", func(f *pbproto.FeedMessage) {
+			vehicle(f).CurrentStopSequence = proto.Uint32(2)
+		}, true},
+		{"E002", "vehicle at the next stop of its trip update", func(f *pbproto.FeedMessage) {
+			vehicle(f).StopId = proto.String("s2")
+			vehicle(f).CurrentStopSequence = proto.Uint32(2)
+		}, false},
+
+		{"E012", "trip update after the header", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Timestamp = proto.Uint64(validationNow + 10)
+		}, true},
+		{"E012", "trip update as old as the header", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Timestamp = proto.Uint64(validationNow)
+		}, false},
+
+		{"E020", "start_time without leading zero", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Trip.StartTime = proto.String("8:00:00")
+		}, true},
+		{"E020", "start_time past midnight", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Trip.StartTime = proto.String("25:30:00")
+		}, false},
+
+		{"E021", "start_date with dashes", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Trip.StartDate = proto.String("2023-11-14")
+		}, true},
+		{"E021", "start_date at the end of the year", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Trip.StartDate = proto.String("20231231")
+		}, false},
+
+		{"E022", "arrival before the previous departure", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).Arrival.Time = proto.Int64(validationNow + 80)
+		}, true},
+		{"E022", "arrival at the previous departure", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).Arrival.Time = proto.Int64(validationNow + 90)
+		}, false},
+
+		{"E025", "departure before the arrival", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 0).Departure.Time = proto.Int64(validationNow + 50)
+		}, true},
+		{"E025", "departure at the arrival", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 0).Departure.Time = proto.Int64(validationNow + 60)
+		}, false},
+
+		{"E026", "latitude past the pole", func(f *pbproto.FeedMessage) {
+			vehicle(f).Position.Latitude = proto.Float32(91)
+		}, true},
+		{"E026", "latitude at the pole", func(f *pbproto.FeedMessage) {
+			vehicle(f).Position.Latitude = proto.Float32(-90)
+		}, false},
+
+		{"E027", "bearing of a full turn", func(f *pbproto.FeedMessage) {
+			vehicle(f).Position.Bearing = proto.Float32(360)
+		}, true},
+		{"E027", "bearing just short of a full turn", func(f *pbproto.FeedMessage) {
+			vehicle(f).Position.Bearing = proto.Float32(359.9)
+		}, false},
+
+		{"E032", "alert without informed entities", func(f *pbproto.FeedMessage) {
+			alert(f).InformedEntity = nil
+		}, true},
+		{"E032", "alert informing a stop", func(f *pbproto.FeedMessage) {
+			alert(f).InformedEntity = []*pbproto.EntitySelector{{StopId: proto.String("s1")}}
+		}, false},
+
+		{"E033", "informed entity without specifier", func(f *pbproto.FeedMessage) {
+			alert(f).InformedEntity = []*pbproto.EntitySelector{{}}
+		}, true},
+		{"E033", "informed entity with a route_type", func(f *pbproto.FeedMessage) {
+			alert(f).InformedEntity = []*pbproto.EntitySelector{{RouteType: proto.Int32(0)}}
+		}, false},
+
+		{"E036", "same stop_sequence twice", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopSequence = proto.Uint32(1)
+		}, true},
+		{"E036", "stop_sequence not set on the second stop", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopSequence = nil
+		}, false},
+
+		{"E037", "same stop_id twice", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopId = proto.String("s1")
+		}, true},
+		{"E037", "stop_id not set on the second stop", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopId = nil
+		}, false},
+
+		{"E038", "version without minor number", func(f *pbproto.FeedMessage) {
+			f.Header.GtfsRealtimeVersion = proto.String("2")
+		}, true},
+		{"E038", "newer version", func(f *pbproto.FeedMessage) {
+			f.Header.GtfsRealtimeVersion = proto.String("2.1")
+		}, false},
+
+		{"E039", "deleted entity in a full dataset", func(f *pbproto.FeedMessage) {
+			f.Entity = append(f.Entity, &pbproto.FeedEntity{Id: proto.String("gone"), IsDeleted: proto.Bool(true)})
+		}, true},
+		{"E039", "deleted entity in a differential feed", func(f *pbproto.FeedMessage) {
+			f.Header.Incrementality = pbproto.FeedHeader_DIFFERENTIAL.Enum()
+			f.Entity = append(f.Entity, &pbproto.FeedEntity{Id: proto.String("gone"), IsDeleted: proto.Bool(true)})
+		}, false},
+
+		{"E040", "stop without stop_id nor stop_sequence", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopId = nil
+			stopTimeUpdate(f, 1).StopSequence = nil
+		}, true},
+		{"E040", "stop with a stop_id alone", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).StopSequence = nil
+		}, false},
+
+		{"E041", "scheduled trip without stops", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).StopTimeUpdate = nil
+		}, true},
+		{"E041", "canceled trip without stops", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).StopTimeUpdate = nil
+			tripUpdate(f).Trip.ScheduleRelationship = pbproto.TripDescriptor_CANCELED.Enum()
+		}, false},
+
+		{"E042", "NO_DATA stop with an arrival", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).ScheduleRelationship = pbproto.TripUpdate_StopTimeUpdate_NO_DATA.Enum()
+			stopTimeUpdate(f, 1).Departure = nil
+		}, true},
+		{"E042", "NO_DATA stop without predictions", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).ScheduleRelationship = pbproto.TripUpdate_StopTimeUpdate_NO_DATA.Enum()
+			stopTimeUpdate(f, 1).Arrival = nil
+			stopTimeUpdate(f, 1).Departure = nil
+		}, false},
+
+		{"E043", "scheduled stop without arrival nor departure", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).Arrival = nil
+			stopTimeUpdate(f, 1).Departure = nil
+		}, true},
+		{"E043", "skipped stop without arrival nor departure", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).ScheduleRelationship = pbproto.TripUpdate_StopTimeUpdate_SKIPPED.Enum()
+			stopTimeUpdate(f, 1).Arrival = nil
+			stopTimeUpdate(f, 1).Departure = nil
+		}, false},
+
+		{"E044", "departure with an uncertainty alone", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).Departure = &pbproto.TripUpdate_StopTimeEvent{Uncertainty: proto.Int32(30)}
+		}, true},
+		{"E044", "departure with a delay and an uncertainty", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 1).Departure = &pbproto.TripUpdate_StopTimeEvent{Delay: proto.Int32(60), Uncertainty: proto.Int32(30)}
+		}, false},
+
+		{"E048", "version 2.0 without header timestamp", func(f *pbproto.FeedMessage) {
+			f.Header.Timestamp = nil
+		}, true},
+		{"E048", "version 1.0 without header timestamp", func(f *pbproto.FeedMessage) {
+			f.Header.GtfsRealtimeVersion = proto.String("1.0")
+			f.Header.Timestamp = nil
+		}, false},
+
+		{"E049", "version 2.0 without incrementality", func(f *pbproto.FeedMessage) {
+			f.Header.Incrementality = nil
+		}, true},
+		{"E049", "version 1.0 without incrementality", func(f *pbproto.FeedMessage) {
+			f.Header.GtfsRealtimeVersion = proto.String("1.0")
+			f.Header.Incrementality = nil
+		}, false},
+
+		{"E050", "header past the clock skew", func(f *pbproto.FeedMessage) {
+			f.Header.Timestamp = proto.Uint64(validationNow + 61)
+		}, true},
+		{"E050", "header within the clock skew", func(f *pbproto.FeedMessage) {
+			f.Header.Timestamp = proto.Uint64(validationNow + 60)
+		}, false},
+
+		{"W001", "vehicle position without timestamp", func(f *pbproto.FeedMessage) {
+			vehicle(f).Timestamp = nil
+		}, true},
+		{"W001", "vehicle position with a timestamp of its own", func(f *pbproto.FeedMessage) {
+			vehicle(f).Timestamp = proto.Uint64(validationNow)
+		}, false},
+
+		{"W002", "trip update without vehicle", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Vehicle = nil
+		}, true},
+		{"W002", "trip update with a vehicle id alone", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Vehicle = &pbproto.VehicleDescriptor{Id: proto.String("v2")}
+		}, false},
+
+		{"W006", "trip update with a route alone", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Trip = &pbproto.TripDescriptor{RouteId: proto.String("r1")}
+		}, true},
+		{"W006", "trip update with a trip_id alone", func(f *pbproto.FeedMessage) {
+			tripUpdate(f).Trip = &pbproto.TripDescriptor{TripId: proto.String("t1")}
+		}, false},
+
+		{"PB001", "entity without id", func(f *pbproto.FeedMessage) {
+			f.Entity[2].Id = proto.String("")
+		}, true},
+		{"PB001", "entity with a blank id", func(f *pbproto.FeedMessage) {
+			f.Entity[2].Id = proto.String(" ")
+		}, false},
+
+		{"PB002", "two entities with the same id", func(f *pbproto.FeedMessage) {
+			f.Entity[2].Id = proto.String("tu")
+		}, true},
+		{"PB002", "ids differing by case", func(f *pbproto.FeedMessage) {
+			f.Entity[2].Id = proto.String("TU")
+		}, false},
+
+		{"PB003", "vehicle at 0,0", func(f *pbproto.FeedMessage) {
+			vehicle(f).Position.Latitude = proto.Float32(0)
+			vehicle(f).Position.Longitude = proto.Float32(0)
+		}, true},
+		{"PB003", "vehicle on the equator", func(f *pbproto.FeedMessage) {
+			vehicle(f).Position.Latitude = proto.Float32(0)
+		}, false},
+
+		{"PB004", "negative uncertainty", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 0).Arrival.Uncertainty = proto.Int32(-1)
+		}, true},
+		{"PB004", "zero uncertainty", func(f *pbproto.FeedMessage) {
+			stopTimeUpdate(f, 0).Arrival.Uncertainty = proto.Int32(0)
+		}, false},
+	} {
+		if tc.broken {
+			breaking[tc.code] = true
+		} else {
+			passing[tc.code] = true
+		}
+		t.Run(tc.code+"/"+tc.name, func(t *testing.T) {
+			feed := validFeed()
+			tc.change(feed)
+			r := validateFeed(feed, time.Unix(validationNow, 0), ValidationConfig{MaxFindings: defaultMaxFindings})
+
+			if broken := r.Counts[tc.code] > 0; broken != tc.broken {
+				t.Errorf("%s reported: %v, want %v, findings: %+v", tc.code, broken, tc.broken, r.Findings)
+			}
+		})
+	}
+
+	for code := range validationRules {
+		if !breaking[code] || !passing[code] {
+			t.Errorf("%s: missing a case breaking the rule or one passing it", code)
+		}
+	}
+}
+
+func TestValidateFeedIgnore(t *testing.T) {
+	feed := validFeed()
+	tripUpdate(feed).Vehicle = nil
+	vehicle(feed).Timestamp = nil
+
+	r := validateFeed(feed, time.Unix(validationNow, 0), ValidationConfig{Ignore: []string{"W002"}, MaxFindings: defaultMaxFindings})
+	if r.Counts["W002"] != 0 {
+		t.Errorf("ignored rule W002 reported")
+	}
+	if r.Counts["W001"] != 1 || r.Warnings != 1 {
+		t.Errorf("got %d W001 findings and %d warnings, want 1 and 1", r.Counts["W001"], r.Warnings)
+	}
+}
+
+func TestValidateFeedMaxFindings(t *testing.T) {
+	feed := validFeed()
+	for i := 0; i < 3; i++ {
+		feed.Entity = append(feed.Entity, &pbproto.FeedEntity{Id: proto.String("")})
+	}
+
+	r := validateFeed(feed, time.Unix(validationNow, 0), ValidationConfig{MaxFindings: 2})
+	if r.Counts["PB001"] != 3 || r.Errors != 3 {
+		t.Errorf("got %d PB001 findings and %d errors, want 3 and 3", r.Counts["PB001"], r.Errors)
+	}
+	if len(r.Findings) != 2 || !r.Truncated {
+		t.Errorf("got %d findings listed, truncated %v, want 2 and true", len(r.Findings), r.Truncated)
+	}
+}
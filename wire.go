@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// unknownFieldsKey is the JSON key the fields missing from the schema are
+// rendered under
+const unknownFieldsKey = "_unknown"
+
+// wireValue is a field read straight from the wire format, without a schema.
+// Value is a best-effort guess: a number for the fixed-size and varint types,
+// and for length-delimited data a nested object when it parses as a message,
+// a string when it is printable text, or base64 otherwise.
+type wireValue struct {
+	WireType string      `json:"wire_type"`
+	Value    interface{} `json:"value"`
+	// Set to "base64" when Value holds raw bytes
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// wireTypeNames names the wire types in the JSON output
+var wireTypeNames = map[protowire.Type]string{
+	protowire.VarintType:     "varint",
+	protowire.Fixed32Type:    "fixed32",
+	protowire.Fixed64Type:    "fixed64",
+	protowire.BytesType:      "bytes",
+	protowire.StartGroupType: "group",
+}
+
+// decodeWireFields reads raw protobuf bytes into a map keyed by field number.
+// Each number holds every occurrence of the field, in the order they appear.
+// It fails on anything that is not a well-formed sequence of fields.
+func decodeWireFields(b []byte) (map[string][]wireValue, error) {
+	fields := map[string][]wireValue{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		v := wireValue{WireType: wireTypeNames[typ]}
+		switch typ {
+		case protowire.VarintType:
+			x, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			v.Value, n = json.Number(strconv.FormatUint(x, 10)), m
+		case protowire.Fixed32Type:
+			x, m := protowire.ConsumeFixed32(b)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			v.Value, n = json.Number(strconv.FormatUint(uint64(x), 10)), m
+		case protowire.Fixed64Type:
+			x, m := protowire.ConsumeFixed64(b)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			v.Value, n = json.Number(strconv.FormatUint(x, 10)), m
+		case protowire.BytesType:
+			x, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			v.Value, v.Encoding = guessBytes(x)
+			n = m
+		case protowire.StartGroupType:
+			x, m := protowire.ConsumeGroup(num, b)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			nested, err := decodeWireFields(x)
+			if err != nil {
+				return nil, err
+			}
+			v.Value, n = nested, m
+		default:
+			// An end group without its start, or a reserved wire type
+			return nil, protowire.ParseError(protowire.ConsumeFieldValue(num, typ, b))
+		}
+		b = b[n:]
+
+		key := strconv.Itoa(int(num))
+		fields[key] = append(fields[key], v)
+	}
+	return fields, nil
+}
+
+// guessBytes picks the most likely reading of a length-delimited field.
+// Printable text is tried first: short strings often happen to be valid
+// messages as well, while the tags of the first fields of a message are
+// control characters.
+func guessBytes(b []byte) (interface{}, string) {
+	if isPrintable(b) {
+		return string(b), ""
+	}
+	if nested, err := decodeWireFields(b); err == nil {
+		return nested, ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// isPrintable reports whether b is valid UTF-8 made of printable characters
+// and common whitespace
+func isPrintable(b []byte) bool {
+	if len(b) == 0 || !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// rawJSON renders the fields of a payload decoded without a schema
+func rawJSON(fields map[string][]wireValue, mc MarshalConfig) ([]byte, error) {
+	jsonData, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return mc.reformat(jsonData)
+}
+
+// addUnknownFields walks a message along with its JSON rendering and adds the
+// unknown fields of every message under unknownFieldsKey. Values that are not
+// rendered as JSON objects, such as the well-known types, are left as they are.
+func addUnknownFields(m protoreflect.Message, v interface{}, useProtoNames bool) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if raw := m.GetUnknown(); len(raw) > 0 {
+		if fields, err := decodeWireFields(raw); err == nil {
+			obj[unknownFieldsKey] = fields
+		} else {
+			obj[unknownFieldsKey] = map[string]interface{}{
+				"error": err.Error(),
+				"raw":   base64.StdEncoding.EncodeToString(raw),
+			}
+		}
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		key := fd.JSONName()
+		if useProtoNames {
+			key = string(fd.Name())
+		}
+		child, ok := obj[key]
+		if !ok {
+			return true
+		}
+
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			items, _ := child.([]interface{})
+			list := value.List()
+			for i := 0; i < list.Len() && i < len(items); i++ {
+				addUnknownFields(list.Get(i).Message(), items[i], useProtoNames)
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			entries, _ := child.(map[string]interface{})
+			value.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				addUnknownFields(mv.Message(), entries[k.String()], useProtoNames)
+				return true
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			addUnknownFields(value.Message(), child, useProtoNames)
+		}
+		return true
+	})
+}